@@ -3,7 +3,7 @@
 
 use core::arch::global_asm;
 use crate::syscall::{Syscall};
-use crate::system::{close, open, print, read, write_u8_slice, write_ptr, socket};
+use crate::system::{close, open, print, read, write_u8_slice, write_ptr, socket, O_CREAT};
 
 mod screen;
 mod syscall;
@@ -15,7 +15,7 @@ global_asm!(include_str!("../start.s")); // init stack pointer
 pub extern "C" fn main() -> ! {
     print(b"Running syscalls.\n");
 
-    let writing_file = open(b"./file.txt", 0);
+    let writing_file = open(b"./file.txt", O_CREAT);
     if writing_file < 0 {
         print(b"open write file failed\n");
     }
@@ -7,6 +7,9 @@ pub fn print(msg: &[u8]) {
     }
 }
 
+// Linux RISC-V O_CREAT. Without it, opening a missing file fails with ENOENT.
+pub const O_CREAT: isize = 0x40;
+
 pub fn open(path_name: &[u8], flags: isize) -> isize {
     unsafe {
         syscall3(Syscall::Open, path_name.as_ptr() as isize, path_name.len() as isize, flags)
@@ -267,7 +267,8 @@ FROM clickv.memory m
 WHERE m.address >= {o:UInt32} AND m.address < {o:UInt32} + 32
 ORDER BY m.address ASC LIMIT 32;
 
-CREATE TABLE IF NOT EXISTS clickv.load_program (hex String)
+-- offset is the base address for the first byte, so data (e.g. a WAD) can be loaded outside of ROM
+CREATE TABLE IF NOT EXISTS clickv.load_program (hex String, offset UInt32 DEFAULT 0)
 ENGINE = Null;
 
 -- Convert hex (whitespace ignored) to memory table
@@ -279,7 +280,7 @@ WITH
 	replaceAll(replaceAll(replaceAll(replaceAll(raw_program_hex, ' ', ''), '\r', ''), '\n', ''), '\t', '') AS program_hex,
 	toUInt32(length(program_hex)) AS byte_count,
 	range(0, byte_count, 2) AS byte_iter,
-	0x0 AS program_offset
+	lp.offset AS program_offset
 SELECT
 (arrayJoin(arrayMap((x) -> (x / 2, reinterpretAsUInt8((unhex(substring(program_hex, x+1, 2))))), byte_iter)) AS byte_tuple).1 + program_offset AS address,
 byte_tuple.2 AS value
@@ -1371,6 +1372,8 @@ JOIN clickv.registers rs2 ON rs2.address = getins_rs2(instruction);
 ----------------------------------------------------------------------------
 
 -- instruction filter, reads syscall number from a7 register
+-- RESET (0) is never forwarded: it is host-only (SELECT clickos_syscall(0, [])), since with
+-- clickos-server -reset-clickhouse it rewrites the pc/registers this clock cycle is still writing
 CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_filter TO clickv.ins_ecall_null
 AS SELECT pc, instruction, (SELECT value FROM clickv.registers WHERE address = 0x11) AS syscall_n FROM clickv.next_instruction_of_system_type
 WHERE getins_i_imm(instruction) = 0x0 AND syscall_n > 0;
@@ -1547,6 +1550,249 @@ SELECT
 	bytes_read AS value -- bytes read, or error
 FROM clickv.ins_ecall_clickos_read_output_null;
 
+---------------------------
+-- ClickOS PREAD (17)
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_pread_filter
+TO clickv.ins_ecall_clickos_pread_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n = 17;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_pread_null (syscall_n UInt32) ENGINE = Null;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_pread
+TO clickv.ins_ecall_clickos_pread_output_null
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS fd, -- a0
+	(SELECT value FROM clickv.registers WHERE address = 0xC) AS count, -- a2
+	(SELECT value FROM clickv.registers WHERE address = 0xD) AS offset -- a3
+SELECT
+	clickos_syscall(syscall_n, arrayConcat(uint32_to_byte_array(fd), uint32_to_byte_array(offset), uint32_to_byte_array(count))) AS response_bytes,
+	byte_array_to_uint32(response_bytes) AS bytes_read,
+	arraySlice(response_bytes, 5) AS bytes -- trim first 4 bytes
+FROM clickv.ins_ecall_clickos_pread_null;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_pread_output_null (bytes_read UInt32, bytes Array(UInt8)) ENGINE = Null;
+
+-- set bytes in memory
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_pread_output_memory
+TO clickv.memory
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xB) AS buffer_ptr -- a1
+SELECT
+	-- safe iterator range
+	range(0, if(bytes_read < 0 OR bytes_read > 0x10000, 0, bytes_read), 1) AS byte_iter,
+	(arrayJoin(arrayMap((i) -> (buffer_ptr + i, arrayElement(bytes, i+1)), byte_iter)) AS out).1 AS address,
+	out.2 AS value
+FROM clickv.ins_ecall_clickos_pread_output_null
+WHERE bytes_read > 0; -- only write if bytes were read
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_pread_output_register
+TO clickv.registers
+AS
+SELECT
+	0xA AS address, -- a0
+	bytes_read AS value -- bytes read, or error
+FROM clickv.ins_ecall_clickos_pread_output_null;
+
+---------------------------
+-- ClickOS FTRUNCATE (18)
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_ftruncate_filter
+TO clickv.ins_ecall_clickos_ftruncate_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n = 18;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_ftruncate_null (syscall_n UInt32) ENGINE = Null;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_ftruncate
+TO clickv.registers
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS fd, -- a0
+	(SELECT value FROM clickv.registers WHERE address = 0xB) AS length -- a1
+SELECT
+	clickos_syscall(syscall_n, arrayConcat(uint32_to_byte_array(fd), uint32_to_byte_array(length))) AS response_bytes,
+	0xA AS address, -- a0
+	byte_array_to_uint32(response_bytes) AS value -- status
+FROM clickv.ins_ecall_clickos_ftruncate_null;
+
+---------------------------
+-- ClickOS MKDIR (19)
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_mkdir_filter
+TO clickv.ins_ecall_clickos_mkdir_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n = 19;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_mkdir_null (syscall_n UInt32) ENGINE = Null;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_mkdir
+TO clickv.registers
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS path_name_ptr, -- a0
+	(SELECT value FROM clickv.registers WHERE address = 0xB) AS path_name_len, -- a1
+	(SELECT value FROM clickv.registers WHERE address = 0xC) AS mode -- a2
+SELECT
+	(SELECT groupArray(value) FROM (SELECT address, value FROM clickv.memory WHERE address >= path_name_ptr AND address < (path_name_ptr + path_name_len) ORDER BY address ASC)) path_name_bytes,
+	arrayConcat(path_name_bytes, [0], uint32_to_byte_array(mode)) AS request_bytes,
+	clickos_syscall(syscall_n, request_bytes) AS response_bytes,
+	0xA AS address, -- a0
+	byte_array_to_uint32(response_bytes) AS value -- status
+FROM clickv.ins_ecall_clickos_mkdir_null;
+
+---------------------------
+-- ClickOS UNLINK (20)
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_unlink_filter
+TO clickv.ins_ecall_clickos_unlink_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n = 20;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_unlink_null (syscall_n UInt32) ENGINE = Null;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_unlink
+TO clickv.registers
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS path_name_ptr, -- a0
+	(SELECT value FROM clickv.registers WHERE address = 0xB) AS path_name_len -- a1
+SELECT
+	(SELECT groupArray(value) FROM (SELECT address, value FROM clickv.memory WHERE address >= path_name_ptr AND address < (path_name_ptr + path_name_len) ORDER BY address ASC)) path_name_bytes,
+	arrayConcat(path_name_bytes, [0]) AS request_bytes,
+	clickos_syscall(syscall_n, request_bytes) AS response_bytes,
+	0xA AS address, -- a0
+	byte_array_to_uint32(response_bytes) AS value -- status
+FROM clickv.ins_ecall_clickos_unlink_null;
+
+---------------------------
+-- ClickOS RENAME (21)
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_rename_filter
+TO clickv.ins_ecall_clickos_rename_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n = 21;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_rename_null (syscall_n UInt32) ENGINE = Null;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_rename
+TO clickv.registers
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS old_path_ptr, -- a0
+	(SELECT value FROM clickv.registers WHERE address = 0xB) AS old_path_len, -- a1
+	(SELECT value FROM clickv.registers WHERE address = 0xC) AS new_path_ptr, -- a2
+	(SELECT value FROM clickv.registers WHERE address = 0xD) AS new_path_len -- a3
+SELECT
+	(SELECT groupArray(value) FROM (SELECT address, value FROM clickv.memory WHERE address >= old_path_ptr AND address < (old_path_ptr + old_path_len) ORDER BY address ASC)) old_path_bytes,
+	(SELECT groupArray(value) FROM (SELECT address, value FROM clickv.memory WHERE address >= new_path_ptr AND address < (new_path_ptr + new_path_len) ORDER BY address ASC)) new_path_bytes,
+	arrayConcat(old_path_bytes, [0], new_path_bytes, [0]) AS request_bytes,
+	clickos_syscall(syscall_n, request_bytes) AS response_bytes,
+	0xA AS address, -- a0
+	byte_array_to_uint32(response_bytes) AS value -- status
+FROM clickv.ins_ecall_clickos_rename_null;
+
+---------------------------
+-- ClickOS FDLIST (22)
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_fdlist_filter
+TO clickv.ins_ecall_clickos_fdlist_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n = 22;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_fdlist_null (syscall_n UInt32) ENGINE = Null;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_fdlist
+TO clickv.ins_ecall_clickos_fdlist_output_null
+AS
+SELECT
+	clickos_syscall(syscall_n, []) AS response_bytes,
+	byte_array_to_uint32(response_bytes) AS fd_count,
+	arraySlice(response_bytes, 5) AS bytes -- trim first 4 bytes
+FROM clickv.ins_ecall_clickos_fdlist_null;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_fdlist_output_null (fd_count UInt32, bytes Array(UInt8)) ENGINE = Null;
+
+-- copy as much of the list as fits in the guest buffer
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_fdlist_output_memory
+TO clickv.memory
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS buffer_ptr, -- a0
+	(SELECT value FROM clickv.registers WHERE address = 0xB) AS buffer_len -- a1
+SELECT
+	(arrayJoin(arrayMap((i) -> (buffer_ptr + i, arrayElement(bytes, i+1)), range(0, least(length(bytes), buffer_len), 1))) AS out).1 AS address,
+	out.2 AS value
+FROM clickv.ins_ecall_clickos_fdlist_output_null
+WHERE length(bytes) > 0;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_fdlist_output_register
+TO clickv.registers
+AS
+SELECT
+	0xA AS address, -- a0
+	fd_count AS value -- number of descriptors
+FROM clickv.ins_ecall_clickos_fdlist_output_null;
+
+---------------------------
+-- ClickOS CAPABILITIES (23)
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_capabilities_filter
+TO clickv.ins_ecall_clickos_capabilities_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n = 23;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_capabilities_null (syscall_n UInt32) ENGINE = Null;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_capabilities
+TO clickv.ins_ecall_clickos_capabilities_output_null
+AS
+SELECT
+	clickos_syscall(syscall_n, []) AS response_bytes,
+	byte_array_to_uint32(response_bytes) AS mask_len,
+	arraySlice(response_bytes, 5) AS bytes -- trim first 4 bytes
+FROM clickv.ins_ecall_clickos_capabilities_null;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_capabilities_output_null (mask_len UInt32, bytes Array(UInt8)) ENGINE = Null;
+
+-- copy as much of the bitmask as fits in the guest buffer. Syscalls past the end read as unsupported.
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_capabilities_output_memory
+TO clickv.memory
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS buffer_ptr, -- a0
+	(SELECT value FROM clickv.registers WHERE address = 0xB) AS buffer_len -- a1
+SELECT
+	(arrayJoin(arrayMap((i) -> (buffer_ptr + i, arrayElement(bytes, i+1)), range(0, least(length(bytes), buffer_len), 1))) AS out).1 AS address,
+	out.2 AS value
+FROM clickv.ins_ecall_clickos_capabilities_output_null
+WHERE length(bytes) > 0;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_capabilities_output_register
+TO clickv.registers
+AS
+SELECT
+	0xA AS address, -- a0
+	mask_len AS value -- full mask length in bytes
+FROM clickv.ins_ecall_clickos_capabilities_output_null;
+
 ---------------------------
 -- ClickOS WRITE
 ---------------------------
@@ -1573,6 +1819,34 @@ SELECT
 	byte_array_to_uint32(response_bytes) AS value -- bytes written, or error
 FROM clickv.ins_ecall_clickos_write_null;
 
+---------------------------
+-- ClickOS WRITEV (16)
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_writev_filter
+TO clickv.ins_ecall_clickos_writev_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n = 16;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_writev_null (syscall_n UInt32) ENGINE = Null;
+
+-- The guest buffer holds the segment count, then each segment as (length, bytes), all little endian.
+-- ClickOS validates the layout, a malformed buffer returns an error in a0.
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_writev
+TO clickv.registers
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS fd, -- a0
+	(SELECT value FROM clickv.registers WHERE address = 0xB) AS buffer_ptr, -- a1
+	(SELECT value FROM clickv.registers WHERE address = 0xC) AS buffer_len -- a2
+SELECT
+	(SELECT groupArray(value) FROM (SELECT address, value FROM clickv.memory WHERE address >= buffer_ptr AND address < (buffer_ptr + buffer_len) ORDER BY address ASC)) buffer_bytes,
+	clickos_syscall(syscall_n, arrayConcat(uint32_to_byte_array(fd), buffer_bytes)) AS response_bytes,
+	0xA AS address, -- a0
+	byte_array_to_uint32(response_bytes) AS value -- total bytes written, or error
+FROM clickv.ins_ecall_clickos_writev_null;
+
 ---------------------------
 -- ClickOS SOCKET
 ---------------------------
@@ -1599,6 +1873,121 @@ SELECT
 	byte_array_to_uint32(response_bytes) AS value -- socket fd
 FROM clickv.ins_ecall_clickos_socket_null;
 
+---------------------------
+-- ClickOS IOCTL (29)
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_ioctl_filter
+TO clickv.ins_ecall_clickos_ioctl_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n = 29;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_ioctl_null (syscall_n UInt32) ENGINE = Null;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_ioctl
+TO clickv.ins_ecall_clickos_ioctl_output_null
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS fd, -- a0
+	(SELECT value FROM clickv.registers WHERE address = 0xB) AS request -- a1
+SELECT
+	clickos_syscall(syscall_n, arrayConcat(uint32_to_byte_array(fd), uint32_to_byte_array(request))) AS response_bytes,
+	byte_array_to_uint32(response_bytes) AS status,
+	arraySlice(response_bytes, 5) AS bytes -- trim first 4 bytes
+FROM clickv.ins_ecall_clickos_ioctl_null;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_ioctl_output_null (status UInt32, bytes Array(UInt8)) ENGINE = Null;
+
+-- copy the result struct (e.g. winsize) to argp
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_ioctl_output_memory
+TO clickv.memory
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xC) AS argp -- a2
+SELECT
+	(arrayJoin(arrayMap((i) -> (argp + i, arrayElement(bytes, i+1)), range(0, length(bytes), 1))) AS out).1 AS address,
+	out.2 AS value
+FROM clickv.ins_ecall_clickos_ioctl_output_null
+WHERE status = 0 AND length(bytes) > 0;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_ioctl_output_register
+TO clickv.registers
+AS
+SELECT
+	0xA AS address, -- a0
+	status AS value -- 0, or error
+FROM clickv.ins_ecall_clickos_ioctl_output_null;
+
+---------------------------
+-- ClickOS GETRANDOM (278)
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_getrandom_filter
+TO clickv.ins_ecall_clickos_getrandom_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n = 278;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_getrandom_null (syscall_n UInt32) ENGINE = Null;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_getrandom
+TO clickv.ins_ecall_clickos_getrandom_output_null
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xB) AS count -- a1
+SELECT
+	clickos_syscall(syscall_n, uint32_to_byte_array(count)) AS response_bytes,
+	byte_array_to_uint32(response_bytes) AS bytes_read,
+	arraySlice(response_bytes, 5) AS bytes -- trim first 4 bytes
+FROM clickv.ins_ecall_clickos_getrandom_null;
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_getrandom_output_null (bytes_read UInt32, bytes Array(UInt8)) ENGINE = Null;
+
+-- set bytes in memory
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_getrandom_output_memory
+TO clickv.memory
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS buffer_ptr -- a0
+SELECT
+	(arrayJoin(arrayMap((i) -> (buffer_ptr + i, arrayElement(bytes, i+1)), range(0, length(bytes), 1))) AS out).1 AS address,
+	out.2 AS value
+FROM clickv.ins_ecall_clickos_getrandom_output_null
+WHERE length(bytes) > 0;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_getrandom_output_register
+TO clickv.registers
+AS
+SELECT
+	0xA AS address, -- a0
+	bytes_read AS value -- bytes filled, or error
+FROM clickv.ins_ecall_clickos_getrandom_output_null;
+
+---------------------------
+-- ClickOS libc startup stubs (set_tid_address, getpid, getppid, getuid, geteuid, getgid, getegid, gettid)
+-- Requires clickos-server -libc-stubs
+---------------------------
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_libc_stub_filter
+TO clickv.ins_ecall_clickos_libc_stub_null
+AS
+SELECT syscall_n FROM clickv.ins_ecall_null
+WHERE syscall_n IN (96, 172, 173, 174, 175, 176, 177, 178);
+
+CREATE TABLE IF NOT EXISTS clickv.ins_ecall_clickos_libc_stub_null (syscall_n UInt32) ENGINE = Null;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_clickos_libc_stub
+TO clickv.registers
+AS
+WITH
+	(SELECT value FROM clickv.registers WHERE address = 0xA) AS arg -- a0
+SELECT
+	clickos_syscall(syscall_n, uint32_to_byte_array(arg)) AS response_bytes,
+	0xA AS address, -- a0
+	byte_array_to_uint32(response_bytes) AS value -- stubbed result
+FROM clickv.ins_ecall_clickos_libc_stub_null;
+
 -- after any/all syscalls, increment PC
 CREATE MATERIALIZED VIEW IF NOT EXISTS clickv.ins_ecall_incr_pc TO clickv.pc AS SELECT pc + 4 AS value FROM clickv.ins_ecall_null;
 
@@ -1660,9 +2049,12 @@ INSERT INTO clickv.memory (address, value) SELECT number AS address, 0 AS value
 TRUNCATE TABLE clickv.print;
 
 -- Reset ClickOS (Optional)
+-- With clickos-server -reset-clickhouse this also does everything above, keeping the current memory size.
+-- Run it between clock cycles, never while the clock is running.
 -- SELECT clickos_syscall(0, []);
 
 -- Paste actual program here. Whitespace is removed automatically.
+-- To load at another base address: INSERT INTO clickv.load_program (hex, offset) VALUES ('...', 2048);
 INSERT INTO clickv.load_program (hex) VALUES ('
 
 ');
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
@@ -10,6 +12,7 @@ import (
 	"time"
 
 	"clickhouse.com/clickv/internal/clickos"
+	"clickhouse.com/clickv/internal/logger"
 )
 
 // Volume bind mounts
@@ -17,28 +20,50 @@ import (
 // clickos_client --> /var/lib/clickhouse/user_scripts/clickos_client
 
 const defaultServerAddr = "host.docker.internal:9008"
+const defaultReadTimeout = 5 * time.Second
+
+// The UDF command line is fixed in the XML, so the read timeout can also come from the environment.
+const readTimeoutEnv = "CLICKOS_READ_TIMEOUT"
 
 func main() {
 	logFile := setupLogging()
 	defer logFile.Close()
 
+	readTimeout := flag.Duration("read-timeout", getDefaultReadTimeout(), "how long to wait for each response datagram from the OS server (env "+readTimeoutEnv+")")
+	flag.Parse()
+
 	serverAddr := defaultServerAddr
-	if len(os.Args) > 1 {
-		serverAddr = os.Args[1]
+	if flag.NArg() > 0 {
+		serverAddr = flag.Arg(0)
 	}
 
 	msgIn := make(chan string)
 	msgOut := make(chan string)
 	done := make(chan struct{})
 
-	go startOSClient(serverAddr, msgIn, msgOut, done)
+	go startOSClient(serverAddr, *readTimeout, msgIn, msgOut, done)
 	go startScanner(msgIn, done)
 
 	for res := range msgOut {
 		WriteStringResponse(res)
 	}
 
-	log.Println("exiting")
+	logger.Infof("exiting")
+}
+
+func getDefaultReadTimeout() time.Duration {
+	value, ok := os.LookupEnv(readTimeoutEnv)
+	if !ok {
+		return defaultReadTimeout
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Warnf("invalid %s %q, using %s: %v", readTimeoutEnv, value, defaultReadTimeout, err)
+		return defaultReadTimeout
+	}
+
+	return timeout
 }
 
 // setupLogging configures the logger to write to a file, since STDOUT is used for ClickHouse<->UDF communication.
@@ -54,28 +79,222 @@ func setupLogging() *os.File {
 	return file
 }
 
-func startOSClient(serverAddr string, msgIn <-chan string, msgOut chan<- string, done <-chan struct{}) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("client panic:", r)
+// A transient network blip shouldn't wedge the guest, so each request is retried with backoff.
+const maxRequestAttempts = 4
+const retryBackoff = 100 * time.Millisecond
+
+type osClient struct {
+	serverAddr  string
+	readTimeout time.Duration
+	conn        *net.UDPConn
+	nextID      uint64
+}
+
+// newOSClient starts request ids at a random point so ids from different client processes don't collide
+// in the server's response cache. 0 is never sent, it means "no id".
+func newOSClient(serverAddr string, readTimeout time.Duration) *osClient {
+	return &osClient{
+		serverAddr:  serverAddr,
+		readTimeout: readTimeout,
+		nextID:      rand.Uint64() | 1,
+	}
+}
+
+func (c *osClient) dial() error {
+	resolvedAddr, err := net.ResolveUDPAddr("udp", c.serverAddr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve host address: %w", err)
+	}
+
+	conn, err := net.DialUDP("udp", nil, resolvedAddr)
+	if err != nil {
+		return fmt.Errorf("failed to dial UDP: %w", err)
+	}
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.conn = conn
+
+	return nil
+}
+
+func (c *osClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+func (c *osClient) write(line string) error {
+	err := c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if err != nil {
+		return fmt.Errorf("failed to set write deadline: %w", err)
+	}
+
+	_, err = c.conn.Write([]byte(line))
+	if err != nil {
+		return fmt.Errorf("failed to write request to OS: %w", err)
+	}
+
+	err = c.conn.SetWriteDeadline(time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to reset write deadline: %w", err)
+	}
+
+	return nil
+}
+
+// read assembles a response that the server may have split over several datagrams.
+// Chunks must arrive in order: a missing or reordered chunk drops the partial response,
+// and the read times out so the request is retried, rather than returning a truncated response.
+// Responses framed with another request id are late answers to an earlier attempt, and are skipped.
+func (c *osClient) read(id uint64) (string, error) {
+	buffer := make([]byte, clickos.MaxDatagramSize)
+	var response []byte
+	next, total := 0, 0
+	for {
+		err := c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		if err != nil {
+			return "", fmt.Errorf("failed to set read deadline: %w", err)
 		}
-		close(msgOut)
-	}()
 
-	resolvedAddr, err := net.ResolveUDPAddr("udp", serverAddr)
+		n, _, err := c.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return "", fmt.Errorf("failed to read response from OS: %w", err)
+		}
+
+		seq, chunks, chunk, err := clickos.ParseChunk(buffer[:n])
+		if err != nil {
+			logger.Debugf("discarding datagram: %v", err)
+			response, next = nil, 0
+			continue
+		}
+		if seq == 0 {
+			response, next, total = nil, 0, chunks
+		} else if seq != next || chunks != total {
+			logger.Debugf("discarding chunk %d/%d, expected %d/%d", seq, chunks, next, total)
+			response, next = nil, 0
+			continue
+		}
+
+		response = append(response, chunk...)
+		next++
+		if next < total {
+			continue
+		}
+
+		responseID, body, err := clickos.ParseResponseFrame(string(response))
+		if err != nil {
+			return "", fmt.Errorf("failed to parse response from OS: %w", err)
+		}
+		response, next = nil, 0
+		if responseID != 0 && responseID != id {
+			logger.Debugf("discarding stale response for request %d, waiting for %d", responseID, id)
+			continue
+		}
+
+		err = c.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return "", fmt.Errorf("failed to reset read deadline: %w", err)
+		}
+
+		return body, nil
+	}
+}
+
+// drain discards datagrams that arrived after their request was answered, e.g. the second
+// response the server sends when a slow original and its retry both complete.
+func (c *osClient) drain() {
+	err := c.conn.SetReadDeadline(time.Now())
 	if err != nil {
-		log.Fatalln("failed to resolve host address:", err)
 		return
 	}
 
-	conn, err := net.DialUDP("udp", nil, resolvedAddr)
+	buffer := make([]byte, clickos.MaxDatagramSize)
+	for {
+		_, _, err := c.conn.ReadFromUDP(buffer)
+		if err != nil {
+			break
+		}
+		logger.Debugf("discarded a late datagram before sending a request")
+	}
+
+	c.conn.SetReadDeadline(time.Time{})
+}
+
+// Request sends a line to the OS server and waits for the response.
+// Read timeouts are retried on the same connection, any other failure re-dials the server first.
+// Every attempt carries the same request id, so the server won't run the syscall again if only the response was lost.
+func (c *osClient) Request(line string) (string, error) {
+	id := c.nextID
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID++
+	}
+	line = fmt.Sprintf("%s\t%d", line, id)
+
+	// Nothing is outstanding yet, anything already queued belongs to an earlier request
+	c.drain()
+
+	backoff := retryBackoff
+	var err error
+	for attempt := 1; attempt <= maxRequestAttempts; attempt++ {
+		if attempt > 1 {
+			logger.Warnf("retrying request (attempt %d/%d) in %s: %v", attempt, maxRequestAttempts, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err = c.write(line)
+		if err != nil {
+			c.redial()
+			continue
+		}
+
+		var response string
+		response, err = c.read(id)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				c.redial()
+			}
+			continue
+		}
+
+		return response, nil
+	}
+
+	return "", fmt.Errorf("no response after %d attempts: %w", maxRequestAttempts, err)
+}
+
+func (c *osClient) redial() {
+	err := c.dial()
+	if err != nil {
+		logger.Errorf("failed to reconnect to OS server: %v", err)
+		return
+	}
+
+	logger.Infof("reconnected to OS server: %s", c.serverAddr)
+}
+
+func startOSClient(serverAddr string, readTimeout time.Duration, msgIn <-chan string, msgOut chan<- string, done <-chan struct{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("client panic: %v", r)
+		}
+		close(msgOut)
+	}()
+
+	client := newOSClient(serverAddr, readTimeout)
+	err := client.dial()
 	if err != nil {
-		log.Fatalln("failed to dial UDP:", err)
+		logger.Fatalf("%v", err)
 		return
 	}
-	defer conn.Close()
+	defer client.Close()
 
-	log.Println("connected to OS server:", serverAddr)
+	logger.Infof("connected to OS server: %s", serverAddr)
 
 	for {
 		select {
@@ -83,51 +302,15 @@ func startOSClient(serverAddr string, msgIn <-chan string, msgOut chan<- string,
 			if !ok {
 				return
 			}
-			log.Printf("received input: %s\n", line)
-
-			err = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-			if err != nil {
-				log.Println("failed to set write deadline:", err)
-				msgOut <- GetSyscallFailedResponse()
-				continue
-			}
-
-			_, err := conn.Write([]byte(line))
-			if err != nil {
-				log.Println("failed to write request to OS:", err)
-				msgOut <- GetSyscallFailedResponse()
-				continue
-			}
+			logger.Debugf("received input: %s", line)
 
-			err = conn.SetReadDeadline(time.Time{})
-			if err != nil {
-				log.Println("failed to reset write deadline:", err)
-				msgOut <- GetSyscallFailedResponse()
-				continue
-			}
-
-			buffer := make([]byte, 8192)
-			err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-			if err != nil {
-				log.Println("failed to set read deadline:", err)
-				msgOut <- GetSyscallFailedResponse()
-				continue
-			}
-
-			n, _, err := conn.ReadFromUDP(buffer)
-			if err != nil {
-				log.Println("failed to read response from OS:", err)
-				msgOut <- GetSyscallFailedResponse()
-				continue
-			}
-			err = conn.SetReadDeadline(time.Time{})
+			response, err := client.Request(line)
 			if err != nil {
-				log.Println("failed to reset read deadline:", err)
+				logger.Errorf("request failed: %v", err)
 				msgOut <- GetSyscallFailedResponse()
 				continue
 			}
 
-			response := string(buffer[:n])
 			msgOut <- response
 
 		case <-done:
@@ -139,23 +322,23 @@ func startOSClient(serverAddr string, msgIn <-chan string, msgOut chan<- string,
 func startScanner(msgIn chan<- string, done chan<- struct{}) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Println("scan panic:", r)
+			logger.Errorf("scan panic: %v", r)
 		}
 		close(msgIn)
 		close(done)
 	}()
 
-	log.Println("starting scanner")
+	logger.Infof("starting scanner")
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		line := scanner.Text()
 		msgIn <- line
 	}
 	if err := scanner.Err(); err != nil {
-		log.Println("scan error:", err)
+		logger.Errorf("scan error: %v", err)
 	}
 
-	log.Println("scanner done")
+	logger.Infof("scanner done")
 }
 
 func GetSyscallFailedResponse() string {
@@ -167,6 +350,6 @@ func GetSyscallFailedResponse() string {
 }
 
 func WriteStringResponse(res string) {
-	log.Printf("response: %s\n", res)
+	logger.Debugf("response: %s", res)
 	fmt.Println(res)
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"clickhouse.com/clickv/internal/clickos"
+)
+
+// writeChunks sends a response the way the ClickOS server does, leaving out chunk skip (-1 sends every chunk)
+func writeChunks(conn *net.UDPConn, clientAddr *net.UDPAddr, resp []byte, skip int) {
+	for seq, chunk := range clickos.ChunkResponse(resp) {
+		if seq != skip {
+			conn.WriteToUDP(chunk, clientAddr)
+		}
+	}
+}
+
+// startSlowServer answers each request with the syscall number as its status, like a ClickOS server would frame it.
+// The first request is answered late, after the client has timed out and retried, so that id gets two responses.
+func startSlowServer(t *testing.T, delay time.Duration) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var requests atomic.Int32
+	go func() {
+		buffer := make([]byte, clickos.MaxDatagramSize)
+		for {
+			n, clientAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			req, err := clickos.ParseInputTSV(string(buffer[:n]))
+			if err != nil {
+				t.Errorf("failed to parse request: %v", err)
+				return
+			}
+			resp := &clickos.SyscallResponse{Status: int32(req.SyscallN)}
+			framed := clickos.FrameResponse(req.ID, resp.Serialize())
+
+			if requests.Add(1) == 1 {
+				go func() {
+					time.Sleep(delay)
+					writeChunks(conn, clientAddr, framed, -1)
+				}()
+				continue
+			}
+			writeChunks(conn, clientAddr, framed, -1)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestRequest_skips_late_duplicate_response(t *testing.T) {
+	readTimeout := 50 * time.Millisecond
+	client := newOSClient(startSlowServer(t, 2*readTimeout), readTimeout)
+	if err := client.dial(); err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	expected := map[string]string{
+		"1\t[]": string((&clickos.SyscallResponse{Status: 1}).Serialize()),
+		"2\t[]": string((&clickos.SyscallResponse{Status: 2}).Serialize()),
+		"3\t[]": string((&clickos.SyscallResponse{Status: 3}).Serialize()),
+	}
+	for _, line := range []string{"1\t[]", "2\t[]", "3\t[]"} {
+		response, err := client.Request(line)
+		if err != nil {
+			t.Fatalf("request %q failed: %v", line, err)
+		}
+		if response != expected[line] {
+			t.Fatalf("request %q: expected %s, got %s", line, expected[line], response)
+		}
+	}
+}
+
+// startLossyServer answers each request with a response large enough to need several datagrams.
+// The middle chunk of the first answer is lost, so the client only gets the full response on its retry.
+func startLossyServer(t *testing.T, payload []byte) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	var requests atomic.Int32
+	go func() {
+		buffer := make([]byte, clickos.MaxDatagramSize)
+		for {
+			n, clientAddr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+
+			req, err := clickos.ParseInputTSV(string(buffer[:n]))
+			if err != nil {
+				t.Errorf("failed to parse request: %v", err)
+				return
+			}
+			resp := &clickos.SyscallResponse{Status: int32(len(payload)), Bytes: payload}
+			framed := clickos.FrameResponse(req.ID, resp.Serialize())
+
+			skip := -1
+			if requests.Add(1) == 1 {
+				skip = 1
+			}
+			writeChunks(conn, clientAddr, framed, skip)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestRequest_retries_incomplete_response(t *testing.T) {
+	payload := make([]byte, clickos.MaxDatagramSize)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	client := newOSClient(startLossyServer(t, payload), 50*time.Millisecond)
+	if err := client.dial(); err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer client.Close()
+
+	response, err := client.Request("13\t[]")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	expected := string((&clickos.SyscallResponse{Status: int32(len(payload)), Bytes: payload}).Serialize())
+	if response != expected {
+		t.Fatalf("expected the full %d byte response, got %d bytes", len(expected), len(response))
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// responseCache remembers the serialized response for recent requests.
+// When a response datagram is lost the client retries with the same id, and gets the
+// cached response instead of running a WRITE or SEEK twice.
+//
+// Entries are keyed by client address and id, so two client processes that happen to pick
+// the same ids never see each other's responses. A client that re-dials after a network
+// error gets a new source port, so its retry runs the syscall again.
+//
+// A retry can arrive while the original is still running, and doesn't always land on the same
+// queue: once CLOSE removes its fd, the retry goes to the no-fd queue. Begin marks a request as
+// in flight, and a retry for it waits for the original's Finish instead of running alongside it.
+type responseCache struct {
+	lock     sync.Mutex
+	size     int
+	order    *list.List // front is most recently used
+	entries  map[cacheKey]*list.Element
+	inflight map[cacheKey]chan struct{} // closed when the running request finishes
+}
+
+type cacheKey struct {
+	clientAddr string
+	id         uint64
+}
+
+type cachedResponse struct {
+	key  cacheKey
+	resp []byte
+}
+
+func newResponseCache(size int) *responseCache {
+	return &responseCache{
+		size:     size,
+		order:    list.New(),
+		entries:  make(map[cacheKey]*list.Element, size),
+		inflight: make(map[cacheKey]chan struct{}),
+	}
+}
+
+func (c *responseCache) Get(clientAddr string, id uint64) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	element, ok := c.entries[cacheKey{clientAddr, id}]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(element)
+	return element.Value.(*cachedResponse).resp, true
+}
+
+// Begin returns the cached response for a request, or claims it for the caller to run.
+// While another worker is running the same request, Begin waits for it to finish first.
+// Every claim must be released with Finish.
+func (c *responseCache) Begin(clientAddr string, id uint64) ([]byte, bool) {
+	key := cacheKey{clientAddr, id}
+	for {
+		c.lock.Lock()
+		if element, ok := c.entries[key]; ok {
+			c.order.MoveToFront(element)
+			c.lock.Unlock()
+			return element.Value.(*cachedResponse).resp, true
+		}
+
+		done, running := c.inflight[key]
+		if !running {
+			c.inflight[key] = make(chan struct{})
+			c.lock.Unlock()
+			return nil, false
+		}
+		c.lock.Unlock()
+
+		// Not cached when the original failed with an I/O error, or the cache is disabled. Then the retry runs itself.
+		<-done
+	}
+}
+
+// Finish releases a claim from Begin, caching resp if it's final, and wakes any retry waiting on it.
+func (c *responseCache) Finish(clientAddr string, id uint64, resp []byte, final bool) {
+	if final {
+		c.Put(clientAddr, id, resp)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := cacheKey{clientAddr, id}
+	close(c.inflight[key])
+	delete(c.inflight, key)
+}
+
+func (c *responseCache) Put(clientAddr string, id uint64, resp []byte) {
+	if c.size <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := cacheKey{clientAddr, id}
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*cachedResponse).resp = resp
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cachedResponse{key, resp})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
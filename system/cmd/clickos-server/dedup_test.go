@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"clickhouse.com/clickv/internal/clickos"
+)
+
+func TestResponseCache_evicts_least_recently_used(t *testing.T) {
+	cache := newResponseCache(2)
+	cache.Put("a", 1, []byte("one"))
+	cache.Put("a", 2, []byte("two"))
+	cache.Get("a", 1)
+	cache.Put("a", 3, []byte("three"))
+
+	if _, ok := cache.Get("a", 2); ok {
+		t.Fatalf("expected id 2 to be evicted")
+	}
+	for id, want := range map[uint64]string{1: "one", 3: "three"} {
+		resp, ok := cache.Get("a", id)
+		if !ok || string(resp) != want {
+			t.Fatalf("expected id %d to be cached as %q, got %q (found %v)", id, want, resp, ok)
+		}
+	}
+}
+
+func TestResponseCache_disabled(t *testing.T) {
+	cache := newResponseCache(0)
+	cache.Put("a", 1, []byte("one"))
+
+	if _, ok := cache.Get("a", 1); ok {
+		t.Fatalf("expected a zero-size cache to store nothing")
+	}
+}
+
+func TestHandleRequest_same_id_from_two_clients(t *testing.T) {
+	responses = newResponseCache(16)
+	stats = newSyscallStats()
+	defer clickos.CloseAllDescriptors()
+
+	// Each client opens a different file with the same request id, so each must get its own fd back
+	dir := t.TempDir()
+	open := func(clientAddr string, name string) string {
+		pathName := filepath.Join(dir, name)
+		if err := os.WriteFile(pathName, nil, 0666); err != nil {
+			t.Fatalf("failed to write %s: %v", pathName, err)
+		}
+		payload := append(append([]byte(pathName), 0), 0, 0, 0, 0)
+		return string(handleRequest(clientAddr, &clickos.SyscallRequest{SyscallN: clickos.SYSCALL_OPEN, Bytes: payload, ID: 7}))
+	}
+
+	first := open("127.0.0.1:1000", "first.txt")
+	second := open("127.0.0.1:2000", "second.txt")
+	if first == second {
+		t.Fatalf("expected each client to get its own response, both got %s", first)
+	}
+
+	// A retry from the first client still gets its cached response
+	if retry := open("127.0.0.1:1000", "third.txt"); retry != first {
+		t.Fatalf("expected the retry to get the cached %s, got %s", first, retry)
+	}
+}
+
+func TestResponseCache_retry_waits_for_original(t *testing.T) {
+	cache := newResponseCache(16)
+	if _, ok := cache.Begin("a", 1); ok {
+		t.Fatalf("expected the first Begin to claim the request")
+	}
+
+	retried := make(chan string)
+	go func() {
+		resp, ok := cache.Begin("a", 1)
+		if !ok {
+			t.Errorf("expected the retry to get the original's response")
+		}
+		retried <- string(resp)
+	}()
+
+	select {
+	case resp := <-retried:
+		t.Fatalf("expected the retry to wait for the original, got %q", resp)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cache.Finish("a", 1, []byte("closed"), true)
+	if resp := <-retried; resp != "closed" {
+		t.Fatalf("expected the retry to get %q, got %q", "closed", resp)
+	}
+}
+
+func TestResponseCache_retry_runs_after_io_error(t *testing.T) {
+	cache := newResponseCache(16)
+	cache.Begin("a", 1)
+
+	claimed := make(chan bool)
+	go func() {
+		_, ok := cache.Begin("a", 1)
+		claimed <- !ok
+	}()
+
+	// I/O errors aren't cached, so the waiting retry claims the request and runs it itself
+	cache.Finish("a", 1, nil, false)
+	if !<-claimed {
+		t.Fatalf("expected the retry to claim the request after a non-final response")
+	}
+	cache.Finish("a", 1, []byte("ok"), true)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"clickhouse.com/clickv/internal/clickos"
+)
+
+// Requests that don't target an open fd (OPEN, SOCKET, RESET, or a bad fd) share this queue
+const noFdQueue int32 = -1
+
+// Pending requests per queue before the UDP loop waits for the worker
+const queueSize = 64
+
+// Live fd queues. Past this, requests for other fds wait on the shared queue.
+const maxQueues = 256
+
+// An fd queue with nothing to do for this long is stopped, and started again on its next request
+const queueIdleTimeout = 30 * time.Second
+
+type request struct {
+	clientAddr string
+	req        *clickos.SyscallRequest
+	respond    func([]byte)
+}
+
+type fdQueue struct {
+	requests chan request
+	pending  int // submitted but not yet handled, guarded by dispatcher.lock
+}
+
+// dispatcher runs each fd's requests in arrival order on its own goroutine,
+// so a slow READ on one fd doesn't hold up other fds, but file offsets never interleave.
+// Only open fds get a queue, so a client sending random fds can't start unbounded goroutines,
+// and a queue is stopped once its fd is closed or it goes idle.
+type dispatcher struct {
+	lock        sync.Mutex
+	queues      map[int32]*fdQueue
+	workers     sync.WaitGroup
+	idleTimeout time.Duration
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		queues:      make(map[int32]*fdQueue),
+		idleTimeout: queueIdleTimeout,
+	}
+}
+
+func (d *dispatcher) Submit(r request) {
+	key, ok := clickos.RequestFd(r.req)
+	if !ok || !clickos.DescriptorOpen(key) {
+		key = noFdQueue
+	}
+
+	d.queue(key).requests <- r
+}
+
+// queue counts the request as pending before returning, so the worker can't be stopped before it arrives
+func (d *dispatcher) queue(key int32) *fdQueue {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	queue, ok := d.queues[key]
+	if !ok && key != noFdQueue && len(d.queues) >= maxQueues {
+		key = noFdQueue
+		queue, ok = d.queues[key]
+	}
+	if !ok {
+		queue = &fdQueue{requests: make(chan request, queueSize)}
+		d.queues[key] = queue
+		d.workers.Add(1)
+		go d.work(key, queue)
+	}
+
+	queue.pending++
+	return queue
+}
+
+func (d *dispatcher) work(key int32, queue *fdQueue) {
+	defer d.workers.Done()
+
+	idle := time.NewTimer(d.idleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case r, ok := <-queue.requests:
+			if !ok {
+				return
+			}
+			r.respond(handleRequest(r.clientAddr, r.req))
+
+			d.lock.Lock()
+			queue.pending--
+			d.lock.Unlock()
+			if !clickos.DescriptorOpen(key) && d.stop(key, queue) {
+				return
+			}
+
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(d.idleTimeout)
+		case <-idle.C:
+			if d.stop(key, queue) {
+				return
+			}
+			idle.Reset(d.idleTimeout)
+		}
+	}
+}
+
+// stop removes an fd queue that has nothing pending. The shared queue runs until Close.
+func (d *dispatcher) stop(key int32, queue *fdQueue) bool {
+	if key == noFdQueue {
+		return false
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if queue.pending > 0 || d.queues[key] != queue {
+		return false
+	}
+	delete(d.queues, key)
+	return true
+}
+
+// Live returns the number of running queues
+func (d *dispatcher) Live() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return len(d.queues)
+}
+
+// Close stops accepting requests and waits for queued ones to finish
+func (d *dispatcher) Close() {
+	d.lock.Lock()
+	for _, queue := range d.queues {
+		close(queue.requests)
+	}
+	d.queues = make(map[int32]*fdQueue)
+	d.lock.Unlock()
+
+	d.workers.Wait()
+}
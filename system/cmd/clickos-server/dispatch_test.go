@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"clickhouse.com/clickv/internal/clickos"
+)
+
+// submitAndWait sends one request through the dispatcher and returns its response
+func submitAndWait(t *testing.T, d *dispatcher, syscallN uint32, payload []byte) []byte {
+	done := make(chan []byte, 1)
+	d.Submit(request{"127.0.0.1:1000", &clickos.SyscallRequest{SyscallN: syscallN, Bytes: payload}, func(resp []byte) { done <- resp }})
+
+	select {
+	case resp := <-done:
+		return resp
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no response for syscall %d", syscallN)
+		return nil
+	}
+}
+
+func fdPayload(fd uint32, rest ...uint32) []byte {
+	payload := binary.LittleEndian.AppendUint32(nil, fd)
+	for _, value := range rest {
+		payload = binary.LittleEndian.AppendUint32(payload, value)
+	}
+	return payload
+}
+
+// waitForLive polls, since workers stop themselves after answering
+func waitForLive(t *testing.T, d *dispatcher, expected int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for d.Live() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d live queues, got %d", expected, d.Live())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDispatcher_unknown_fds_share_a_queue(t *testing.T) {
+	responses = newResponseCache(0)
+	stats = newSyscallStats()
+	d := newDispatcher()
+	defer d.Close()
+
+	for fd := uint32(100); fd < 1100; fd++ {
+		submitAndWait(t, d, clickos.SYSCALL_READ, fdPayload(fd, 4))
+	}
+
+	waitForLive(t, d, 1)
+}
+
+func TestDispatcher_stops_queue_when_fd_closes(t *testing.T) {
+	responses = newResponseCache(0)
+	stats = newSyscallStats()
+	d := newDispatcher()
+	defer d.Close()
+	defer clickos.CloseAllDescriptors()
+
+	pathName := filepath.Join(t.TempDir(), "queue.txt")
+	if err := os.WriteFile(pathName, []byte("ClickHouse!"), 0666); err != nil {
+		t.Fatalf("failed to write %s: %v", pathName, err)
+	}
+	submitAndWait(t, d, clickos.SYSCALL_OPEN, append(append([]byte(pathName), 0), 0, 0, 0, 0))
+	fd := uint32(clickos.ListDescriptors()[0].ID)
+
+	submitAndWait(t, d, clickos.SYSCALL_READ, fdPayload(fd, 4))
+	waitForLive(t, d, 2)
+
+	submitAndWait(t, d, clickos.SYSCALL_CLOSE, fdPayload(fd))
+	waitForLive(t, d, 1)
+}
+
+func TestDispatcher_stops_idle_queue(t *testing.T) {
+	responses = newResponseCache(0)
+	stats = newSyscallStats()
+	d := newDispatcher()
+	d.idleTimeout = 10 * time.Millisecond
+	defer d.Close()
+	defer clickos.CloseAllDescriptors()
+
+	pathName := filepath.Join(t.TempDir(), "idle.txt")
+	if err := os.WriteFile(pathName, []byte("ClickHouse!"), 0666); err != nil {
+		t.Fatalf("failed to write %s: %v", pathName, err)
+	}
+	submitAndWait(t, d, clickos.SYSCALL_OPEN, append(append([]byte(pathName), 0), 0, 0, 0, 0))
+	fd := uint32(clickos.ListDescriptors()[0].ID)
+
+	submitAndWait(t, d, clickos.SYSCALL_READ, fdPayload(fd, 4))
+	waitForLive(t, d, 1) // only the shared queue is kept
+
+	// The fd still works after its queue stopped
+	resp := submitAndWait(t, d, clickos.SYSCALL_READ, fdPayload(fd, 4))
+	if expected := string((&clickos.SyscallResponse{Status: 4, Bytes: []byte("kHou")}).Serialize()); string(resp) != expected {
+		t.Fatalf("expected %s, got %s", expected, resp)
+	}
+}
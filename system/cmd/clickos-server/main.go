@@ -1,64 +1,213 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"math"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"clickhouse.com/clickv/internal/clickos"
+	"clickhouse.com/clickv/internal/db"
+	"clickhouse.com/clickv/internal/logger"
 )
 
 const hostAddress = "0.0.0.0:9008"
 
+// Kept below the client's default 5s read timeout, so a slow reset fails instead of
+// running on while the client retries and gives up
+const resetTimeout = 4 * time.Second
+
 func main() {
+	flag.BoolVar(&clickos.LibcStubs, "libc-stubs", false, "answer libc startup syscalls (getpid, getuid, set_tid_address...) with constant values")
+	flag.BoolVar(&clickos.CreateOnOpen, "create-on-open", false, "OPEN creates missing files even when the guest didn't pass O_CREAT")
+	maxRead := flag.Uint("max-read", uint(clickos.MaxReadCount), "largest READ/PREAD count served at once, bigger requests get a short read")
+	randomSeed := flag.Int64("random-seed", 0, "seed GETRANDOM for reproducible runs (default uses crypto/rand)")
+	flag.IntVar(&clickos.PipeBufferSize, "pipe-buffer", clickos.PipeBufferSize, "datagrams buffered per UDP socket before the full policy applies")
+	pipeFull := flag.String("pipe-full", "drop-newest", "what to do when a UDP socket buffer is full: drop-newest, drop-oldest, or block")
+	dedupSize := flag.Int("dedup-size", 1024, "recent responses kept for answering retried requests (0 disables)")
+	recordPath := flag.String("record", "", "log every executed syscall and its response to this file, for cmd/replay")
+	resetClickHouse := flag.Bool("reset-clickhouse", false, "RESET also zeroes the PC, registers, and memory and clears the console in ClickHouse")
+	memorySize := flag.Uint("memory-size", 0, "bytes of memory -reset-clickhouse zeroes (default reads the size of clickv.memory at startup)")
+	flag.Parse()
+
+	clickos.MaxReadCount = uint32(max(min(*maxRead, math.MaxUint32), 1))
+	responses = newResponseCache(*dedupSize)
+	stats = newSyscallStats()
+
+	pipeFullPolicy, err := clickos.ParsePipeFullPolicy(*pipeFull)
+	if err != nil {
+		logger.Fatalf("invalid -pipe-full: %v", err)
+	}
+	clickos.PipeFull = pipeFullPolicy
+
+	if *recordPath != "" {
+		recorder, err = newSessionRecorder(*recordPath)
+		if err != nil {
+			logger.Fatalf("invalid -record: %v", err)
+		}
+	}
+
+	if *randomSeed != 0 {
+		clickos.SeedRandom(*randomSeed)
+	}
+
+	if *resetClickHouse {
+		chConn, err := db.GetClickHouseConnection()
+		if err != nil {
+			logger.Fatalf("failed to connect to ClickHouse for -reset-clickhouse: %v", err)
+		}
+		defer chConn.Close()
+
+		// Read once, a reset truncates clickv.memory so the table can't be trusted for its own size afterwards
+		resetMemorySize := uint32(min(*memorySize, math.MaxUint32))
+		if resetMemorySize == 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+			resetMemorySize, err = db.ReadClickHouseMemorySize(ctx, chConn)
+			cancel()
+			if err != nil {
+				logger.Fatalf("failed to read memory size for -reset-clickhouse: %v", err)
+			}
+			if resetMemorySize == 0 {
+				logger.Fatalf("clickv.memory is empty, load a program first or pass -memory-size")
+			}
+		}
+		logger.Infof("RESET will zero %d bytes of memory", resetMemorySize)
+
+		clickos.ResetHook = func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), resetTimeout)
+			defer cancel()
+
+			return db.ResetClickHouseState(ctx, chConn, resetMemorySize)
+		}
+	}
+
 	resolvedAddr, err := net.ResolveUDPAddr("udp", hostAddress)
 	if err != nil {
-		log.Fatalf("failed to resolve UDP host address: %v", err)
+		logger.Fatalf("failed to resolve UDP host address: %v", err)
 	}
 
 	conn, err := net.ListenUDP("udp", resolvedAddr)
 	if err != nil {
-		log.Fatalf("failed to listen on UDP: %v", err)
+		logger.Fatalf("failed to listen on UDP: %v", err)
 	}
-	defer conn.Close()
-	log.Println("ClickOS listening on", hostAddress)
+	logger.Infof("ClickOS listening on %s", hostAddress)
 
-	buffer := make([]byte, 8192)
+	// Closing the listener unblocks ReadFromUDP so the loop can exit
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-shutdown
+		logger.Infof("received %s, shutting down", sig)
+		conn.Close()
+	}()
+
+	requests := newDispatcher()
+	buffer := make([]byte, clickos.MaxDatagramSize)
 	for {
 		n, clientAddr, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			log.Printf("failed to read from UDP: %v", err)
+		if errors.Is(err, net.ErrClosed) {
+			break
+		} else if err != nil {
+			logger.Errorf("failed to read from UDP: %v", err)
 			continue
 		}
 
 		payload := buffer[:n]
-		log.Printf("received from %s: %v\n", clientAddr.String(), payload)
-		resp, err := handlePacket(clientAddr.String(), payload)
+		logger.Debugf("received from %s: %v", clientAddr.String(), payload)
+
+		respond := func(resp []byte) {
+			err := writeResponse(conn, clientAddr, resp)
+			if err != nil {
+				logger.Errorf("failed to send response: %v", err)
+			}
+		}
+
+		req, err := clickos.ParseInputTSV(string(payload))
 		if err != nil {
-			log.Printf("failed to handle packet: %v", err)
-			errResp := &clickos.SyscallResponse{Status: -1}
-			resp = errResp.Serialize()
+			logger.Warnf("failed to parse input: %v", err)
+			respond(errorResponse())
+			continue
 		}
 
-		_, err = conn.WriteToUDP(resp, clientAddr)
+		requests.Submit(request{clientAddr.String(), req, respond})
+	}
+
+	requests.Close()
+	clickos.CloseAllDescriptors()
+	err = recorder.Close()
+	if err != nil {
+		logger.Errorf("%v", err)
+	}
+	for _, line := range stats.Summary() {
+		logger.Infof("%s", line)
+	}
+	logger.Infof("ClickOS stopped")
+}
+
+// writeResponse sends a response as numbered chunks (large READs span several datagrams). The client reassembles them.
+func writeResponse(conn *net.UDPConn, clientAddr *net.UDPAddr, resp []byte) error {
+	for _, chunk := range clickos.ChunkResponse(resp) {
+		_, err := conn.WriteToUDP(chunk, clientAddr)
 		if err != nil {
-			log.Printf("failed to send response: %v", err)
+			return err
 		}
 	}
+
+	return nil
 }
 
-func handlePacket(clientAddr string, payload []byte) ([]byte, error) {
-	req, err := clickos.ParseInputTSV(string(payload))
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse input: %w", err)
+func errorResponse() []byte {
+	errResp := &clickos.SyscallResponse{Status: -1}
+	return errResp.Serialize()
+}
+
+var responses *responseCache
+var stats *syscallStats
+var recorder *sessionRecorder
+
+// handleRequest runs on a dispatcher worker. Failures are answered with status -1.
+// A retry usually runs on the same queue as the original, but not always (a CLOSE retry finds no fd
+// and goes to the no-fd queue), so the response cache makes a retry wait for an original still in flight.
+func handleRequest(clientAddr string, req *clickos.SyscallRequest) []byte {
+	if req.ID == 0 {
+		resp, _ := muxRequest(clientAddr, req)
+		return clickos.FrameResponse(req.ID, resp)
+	}
+
+	if resp, ok := responses.Begin(clientAddr, req.ID); ok {
+		logger.Debugf("client: %s retried request %d, sending cached response", clientAddr, req.ID)
+		return clickos.FrameResponse(req.ID, resp)
 	}
 
-	log.Printf("client: %s %s\n", clientAddr, req.DebugString())
+	resp, final := muxRequest(clientAddr, req)
+	responses.Finish(clientAddr, req.ID, resp, final)
+
+	return clickos.FrameResponse(req.ID, resp)
+}
+
+// muxRequest reports whether the response is final. Host I/O failures aren't, so a retry runs the call again.
+func muxRequest(clientAddr string, req *clickos.SyscallRequest) ([]byte, bool) {
+	logger.Debugf("client: %s %s", clientAddr, req.DebugString())
+	start := time.Now()
 	resp, err := clickos.MuxCall(req)
-	if err != nil {
-		return nil, fmt.Errorf("syscall %s (%d) failed: %w", clickos.SyscallToName(req.SyscallN), req.SyscallN, err)
+	stats.Record(req.SyscallN, start, time.Now(), err != nil)
+	recordErr := recorder.Record(req, resp, err)
+	if recordErr != nil {
+		logger.Warnf("%v", recordErr)
+	}
+	if clickos.IsClientError(err) {
+		logger.Warnf("client: %s sent a bad %s (%d) request: %v", clientAddr, clickos.SyscallToName(req.SyscallN), req.SyscallN, err)
+		return errorResponse(), true
+	} else if err != nil {
+		logger.Errorf("syscall %s (%d) failed: %v", clickos.SyscallToName(req.SyscallN), req.SyscallN, err)
+		return errorResponse(), false
 	}
 
-	log.Printf("response: %s\n", resp.DebugString())
-	return resp.Serialize(), nil
+	logger.Debugf("response: %s", resp.DebugString())
+	return resp.Serialize(), true
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+
+	"clickhouse.com/clickv/internal/clickos"
+)
+
+// sessionRecorder appends every executed syscall to a log that cmd/replay can run back through MuxCall.
+// Workers for different fds finish in any order, so records are in completion order, which keeps each fd's calls in sequence.
+type sessionRecorder struct {
+	lock   sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func newSessionRecorder(path string) (*sessionRecorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session log: %w", err)
+	}
+
+	return &sessionRecorder{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+// Record is a no-op on a nil recorder, so the server doesn't need to check -record on every call
+func (r *sessionRecorder) Record(req *clickos.SyscallRequest, resp *clickos.SyscallResponse, err error) error {
+	if r == nil {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return clickos.WriteRecord(r.writer, clickos.NewRecord(req, resp, err))
+}
+
+func (r *sessionRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := r.writer.Flush()
+	if err != nil {
+		r.file.Close()
+		return fmt.Errorf("failed to flush session log: %w", err)
+	}
+
+	return r.file.Close()
+}
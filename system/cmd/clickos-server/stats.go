@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"clickhouse.com/clickv/internal/clickos"
+)
+
+// syscallStats counts the syscalls the guest makes, to tell an I/O-bound run from a compute-bound one.
+// The server can't see the guest's instruction count, so the time since the previous syscall
+// finished stands in for how long the guest computed before making each call.
+type syscallStats struct {
+	lock     sync.Mutex
+	calls    map[uint32]*syscallCount
+	lastDone time.Time
+}
+
+type syscallCount struct {
+	calls    uint64
+	failures uint64
+	busy     time.Duration // spent handling the call
+	idle     time.Duration // since the previous syscall finished
+}
+
+func newSyscallStats() *syscallStats {
+	return &syscallStats{
+		calls: make(map[uint32]*syscallCount),
+	}
+}
+
+func (s *syscallStats) Record(syscallN uint32, start time.Time, done time.Time, failed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count, ok := s.calls[syscallN]
+	if !ok {
+		count = &syscallCount{}
+		s.calls[syscallN] = count
+	}
+
+	count.calls++
+	if failed {
+		count.failures++
+	}
+	count.busy += done.Sub(start)
+	// Calls on different fds overlap, only count the gap when there was one
+	if !s.lastDone.IsZero() && start.After(s.lastDone) {
+		count.idle += start.Sub(s.lastDone)
+	}
+	if done.After(s.lastDone) {
+		s.lastDone = done
+	}
+}
+
+// Summary has one line per syscall, most called first
+func (s *syscallStats) Summary() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	syscalls := make([]uint32, 0, len(s.calls))
+	for syscallN := range s.calls {
+		syscalls = append(syscalls, syscallN)
+	}
+	sort.Slice(syscalls, func(i, j int) bool {
+		a, b := s.calls[syscalls[i]], s.calls[syscalls[j]]
+		if a.calls != b.calls {
+			return a.calls > b.calls
+		}
+		return syscalls[i] < syscalls[j]
+	})
+
+	lines := make([]string, 0, len(syscalls))
+	for _, syscallN := range syscalls {
+		count := s.calls[syscallN]
+		lines = append(lines, fmt.Sprintf("%s (%d): %d calls, %d failed, avg %s handling, avg %s since previous syscall",
+			clickos.SyscallToName(syscallN), syscallN, count.calls, count.failures,
+			count.busy/time.Duration(count.calls), count.idle/time.Duration(count.calls)))
+	}
+
+	return lines
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"clickhouse.com/clickv/internal/clickos"
+)
+
+func TestSyscallStats_summary(t *testing.T) {
+	stats := newSyscallStats()
+	start := time.Unix(0, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	stats.Record(clickos.SYSCALL_OPEN, at(0), at(2), false)
+	stats.Record(clickos.SYSCALL_READ, at(10), at(11), false)
+	stats.Record(clickos.SYSCALL_READ, at(21), at(22), true)
+
+	summary := stats.Summary()
+	if len(summary) != 2 {
+		t.Fatalf("expected 2 lines, got %q", summary)
+	}
+	if !strings.HasPrefix(summary[0], "READ (13): 2 calls, 1 failed, avg 1ms handling, avg 9ms since previous syscall") {
+		t.Fatalf("expected READ first with its averages, got %q", summary[0])
+	}
+	if !strings.HasPrefix(summary[1], "OPEN (10): 1 calls, 0 failed") {
+		t.Fatalf("expected OPEN second, got %q", summary[1])
+	}
+}
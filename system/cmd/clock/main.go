@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"slices"
 	"time"
 
 	"clickhouse.com/clickv/internal/db"
 )
 
 func main() {
+	pcEvery := flag.Int64("pc-every", 0, "read and print the PC every N cycles to watch progress (0 disables, the extra SELECT slows the clock)")
+	flag.Parse()
+
 	conn, err := db.GetClickHouseConnection()
 	if err != nil {
 		fmt.Println(err)
@@ -19,20 +24,46 @@ func main() {
 	var lastTime time.Time
 	var cycles int64 = 0
 	var totalCycles int64 = 0
+	// Insert latency is bursty, so the hz figure alone hides stalls. Reset every second.
+	latencies := make([]time.Duration, 0, 1024)
 	for {
+		start := time.Now()
 		err := conn.Exec(context.Background(), "INSERT INTO clickv.clock (_) VALUEs ()")
 		if err != nil {
 			fmt.Println(err)
 		}
+		latencies = append(latencies, time.Since(start))
 		// time.Sleep(500 * time.Millisecond)
 		cycles++
 		totalCycles++
 
+		if *pcEvery > 0 && totalCycles%*pcEvery == 0 {
+			pc, err := db.ReadClickHousePC(context.Background(), conn)
+			if err != nil {
+				fmt.Println(err)
+			} else {
+				fmt.Printf("cycle %d pc: 0x%08x\n", totalCycles, pc)
+			}
+		}
+
 		now = time.Now()
 		if now.Sub(lastTime) > time.Duration(1*time.Second) {
-			fmt.Printf("clock speed: %dhz total cycles: %d\n", cycles, totalCycles)
+			slices.Sort(latencies)
+			fmt.Printf("clock speed: %dhz total cycles: %d latency p50: %s p95: %s p99: %s\n", cycles, totalCycles,
+				percentile(latencies, 50), percentile(latencies, 95), percentile(latencies, 99))
 			cycles = 0
+			latencies = latencies[:0]
 			lastTime = now
 		}
 	}
 }
+
+// percentile uses the nearest-rank method on sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sorted) + 99) / 100 // ceil(p/100 * n)
+	return sorted[max(rank, 1)-1]
+}
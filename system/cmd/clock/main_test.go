@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	tests := map[int]time.Duration{
+		50: 50 * time.Millisecond,
+		95: 95 * time.Millisecond,
+		99: 99 * time.Millisecond,
+	}
+	for p, want := range tests {
+		if got := percentile(sorted, p); got != want {
+			t.Fatalf("p%d: expected %s, got %s", p, want, got)
+		}
+	}
+
+	if got := percentile([]time.Duration{7 * time.Millisecond}, 99); got != 7*time.Millisecond {
+		t.Fatalf("expected the only sample for a single cycle, got %s", got)
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Fatalf("expected 0 with no samples, got %s", got)
+	}
+}
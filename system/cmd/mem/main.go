@@ -1,11 +1,15 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/binary"
+	"flag"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/tidwall/redcon"
 )
@@ -16,190 +20,530 @@ import (
  */
 
 const serverHost = "0.0.0.0:6379"
-const MEM_SIZE = 2048 + 1024 + 800  // ROM, RAM, VRAM
-var memory = make([]byte, MEM_SIZE) // no mutex. CPU is single threaded, plus I like the chaos.
-const REG_SIZE = 32                 // 32 registers
+const ROM_SIZE = 2048
+const RAM_SIZE = 1024
+const VRAM_SIZE = 800
+const MEM_SIZE = ROM_SIZE + RAM_SIZE + VRAM_SIZE // ROM, RAM, VRAM
+var memory = make([]byte, MEM_SIZE)              // no mutex. CPU is single threaded, plus I like the chaos.
+var protected = make([]bool, MEM_SIZE)           // read-only addresses set by PROTECT
+const REG_SIZE = 32                              // 32 registers
 var registers = make([]uint32, REG_SIZE)
 
+// Register writes take this lock so CAS is atomic against SET/MSET from other connections
+var registersLock sync.Mutex
+
+// Keys returned per SCAN call when no COUNT is given, same as Redis
+const DEFAULT_SCAN_COUNT = 10
+
 const (
 	REGISTER_DB = 0
 	MEMORY_DB   = 1
 )
 
+// Selected db per connection, keyed by remote address.
+// redcon serves each connection on its own goroutine, so this needs a lock.
+var connToDB = make(map[string]int, 2)
+var connToDBLock sync.Mutex
+
+// Connections that passed AUTH. Only checked when requirePass is set.
+var connAuthed = make(map[string]bool, 2)
+var requirePass = ""
+
+func getConnDB(conn redcon.Conn) int {
+	connToDBLock.Lock()
+	defer connToDBLock.Unlock()
+	return connToDB[conn.RemoteAddr()]
+}
+
+func setConnDB(conn redcon.Conn, db int) {
+	connToDBLock.Lock()
+	defer connToDBLock.Unlock()
+	connToDB[conn.RemoteAddr()] = db
+}
+
+func isAuthed(conn redcon.Conn) bool {
+	if requirePass == "" {
+		return true
+	}
+
+	connToDBLock.Lock()
+	defer connToDBLock.Unlock()
+	return connAuthed[conn.RemoteAddr()]
+}
+
+func setAuthed(conn redcon.Conn) {
+	connToDBLock.Lock()
+	defer connToDBLock.Unlock()
+	connAuthed[conn.RemoteAddr()] = true
+}
+
 func main() {
+	flag.StringVar(&requirePass, "requirepass", os.Getenv("MEM_REQUIREPASS"), "require clients to AUTH with this password (env MEM_REQUIREPASS)")
+	flag.Parse()
+
 	go log.Printf("started server at %s", serverHost)
 
-	var connToDB = make(map[string]int, 2)
-	err := redcon.ListenAndServe(serverHost,
-		func(conn redcon.Conn, cmd redcon.Command) {
-			db := connToDB[conn.RemoteAddr()]
-			fmt.Printf("user: %s db: %d, cmd: %s args: %d\n", conn.RemoteAddr(), db, string(cmd.Args[0]), len(cmd.Args[1:]))
-
-			switch strings.ToLower(string(cmd.Args[0])) {
-			default:
-				conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
-			case "ping":
-				conn.WriteString("PONG")
-			case "quit":
-				conn.WriteString("OK")
-				conn.Close()
-			case "select":
-				dbByte := string(cmd.Args[1])
-				db, _ := strconv.ParseInt(dbByte, 10, 32)
-				connToDB[conn.RemoteAddr()] = int(db)
-				conn.WriteString("OK")
-			case "set":
-				if len(cmd.Args) != 3 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
+	err := redcon.ListenAndServe(serverHost, handleCommand, acceptConn, closedConn)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-				switch db {
-				case REGISTER_DB:
-					reg := cmd.Args[1][0]
-
-					// x0 is always 0
-					if reg == 0 {
-						conn.WriteString("OK")
-						return
-					} else if reg > 31 {
-						conn.WriteError("ERR register address out of range")
-						return
-					}
-
-					registers[reg] = binary.LittleEndian.Uint32(cmd.Args[2])
-				case MEMORY_DB:
-					addr := binary.LittleEndian.Uint32(cmd.Args[1])
-					if addr > MEM_SIZE {
-						conn.WriteError("ERR memory address out of range")
-						return
-					}
-
-					memory[addr] = cmd.Args[2][0]
-				}
+func acceptConn(conn redcon.Conn) bool {
+	setConnDB(conn, 0)
+	return true
+}
+
+// closedConn forgets the connection, otherwise connToDB grows with every reconnecting client.
+func closedConn(conn redcon.Conn, err error) {
+	connToDBLock.Lock()
+	defer connToDBLock.Unlock()
+	delete(connToDB, conn.RemoteAddr())
+	delete(connAuthed, conn.RemoteAddr())
+}
+
+func handleCommand(conn redcon.Conn, cmd redcon.Command) {
+	db := getConnDB(conn)
+	fmt.Printf("user: %s db: %d, cmd: %s args: %d\n", conn.RemoteAddr(), db, string(cmd.Args[0]), len(cmd.Args[1:]))
+
+	name := strings.ToLower(string(cmd.Args[0]))
+	if name != "auth" && name != "ping" && name != "quit" && !isAuthed(conn) {
+		conn.WriteError("NOAUTH Authentication required.")
+		return
+	}
 
+	switch name {
+	default:
+		conn.WriteError("ERR unknown command '" + string(cmd.Args[0]) + "'")
+	case "ping":
+		conn.WriteString("PONG")
+	case "quit":
+		conn.WriteString("OK")
+		conn.Close()
+	case "auth":
+		// AUTH <password> or AUTH <username> <password>, only the default user exists
+		if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		if requirePass == "" {
+			conn.WriteError("ERR AUTH <password> called without any password configured for the default user")
+			return
+		}
+
+		password := cmd.Args[len(cmd.Args)-1]
+		userOK := len(cmd.Args) == 2 || string(cmd.Args[1]) == "default"
+		if !userOK || subtle.ConstantTimeCompare(password, []byte(requirePass)) != 1 {
+			conn.WriteError("WRONGPASS invalid username-password pair or user is disabled.")
+			return
+		}
+
+		setAuthed(conn)
+		conn.WriteString("OK")
+	case "command":
+		// Clients send COMMAND / COMMAND DOCS on connect. Report no command metadata.
+		if len(cmd.Args) > 1 && strings.ToLower(string(cmd.Args[1])) == "count" {
+			conn.WriteInt(0)
+			return
+		}
+		conn.WriteArray(0)
+	case "info":
+		conn.WriteBulkString(getInfo())
+	case "dbsize":
+		switch db {
+		case REGISTER_DB:
+			conn.WriteInt(REG_SIZE)
+		case MEMORY_DB:
+			conn.WriteInt(MEM_SIZE)
+		default:
+			conn.WriteInt(0)
+		}
+	case "regions":
+		// Each region is [name, start, end) so tooling can discover the memory map
+		switch db {
+		case REGISTER_DB:
+			conn.WriteArray(1)
+			writeRegion(conn, "registers", 0, REG_SIZE)
+		case MEMORY_DB:
+			conn.WriteArray(3)
+			writeRegion(conn, "rom", 0, ROM_SIZE)
+			writeRegion(conn, "ram", ROM_SIZE, ROM_SIZE+RAM_SIZE)
+			writeRegion(conn, "vram", ROM_SIZE+RAM_SIZE, MEM_SIZE)
+		default:
+			conn.WriteArray(0)
+		}
+	case "hello":
+		// redcon only speaks RESP2. NOPROTO makes RESP3 clients fall back, like an older Redis would.
+		if len(cmd.Args) > 1 && string(cmd.Args[1]) != "2" {
+			conn.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		writeHello(conn)
+	case "select":
+		dbByte := string(cmd.Args[1])
+		db, _ := strconv.ParseInt(dbByte, 10, 32)
+		setConnDB(conn, int(db))
+		conn.WriteString("OK")
+	case "set":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		switch db {
+		case REGISTER_DB:
+			reg := cmd.Args[1][0]
+
+			// x0 is always 0
+			if reg == 0 {
 				conn.WriteString("OK")
-			case "get":
-				if len(cmd.Args) != 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
-					return
-				}
+				return
+			} else if reg > 31 {
+				conn.WriteError("ERR register address out of range")
+				return
+			}
+
+			registersLock.Lock()
+			registers[reg] = binary.LittleEndian.Uint32(cmd.Args[2])
+			registersLock.Unlock()
+		case MEMORY_DB:
+			addr := binary.LittleEndian.Uint32(cmd.Args[1])
+			if addr >= MEM_SIZE {
+				conn.WriteError("ERR memory address out of range")
+				return
+			} else if protected[addr] {
+				conn.WriteError("ERR memory address is write protected")
+				return
+			}
+
+			memory[addr] = cmd.Args[2][0]
+		}
+
+		conn.WriteString("OK")
+	case "get":
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		switch db {
+		case REGISTER_DB:
+			reg := cmd.Args[1][0]
+			value := registers[reg]
+			conn.WriteAny(value)
+		case MEMORY_DB:
+			addr := binary.LittleEndian.Uint32(cmd.Args[1])
+			if addr >= MEM_SIZE {
+				conn.WriteError("ERR memory address out of range")
+				return
+			}
+
+			value := memory[addr]
+			conn.WriteAny(value)
+		}
+	case "mset":
+		if len(cmd.Args) < 3 || len(cmd.Args)%2 != 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
 
-				switch db {
-				case REGISTER_DB:
-					reg := cmd.Args[1][0]
-					value := registers[reg]
-					conn.WriteAny(value)
-				case MEMORY_DB:
-					addr := binary.LittleEndian.Uint32(cmd.Args[1])
-					if addr > MEM_SIZE {
-						conn.WriteError("ERR memory address out of range")
-						return
-					}
-
-					value := memory[addr]
-					conn.WriteAny(value)
+		// Check every address before writing any, so a rejected MSET leaves nothing half written
+		for i := 1; i < len(cmd.Args); i += 2 {
+			switch db {
+			case REGISTER_DB:
+				if cmd.Args[i][0] > 31 {
+					conn.WriteError("ERR register address out of range")
+					return
 				}
-			case "mset":
-				if len(cmd.Args) < 3 || len(cmd.Args)%2 != 1 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			case MEMORY_DB:
+				addr := binary.LittleEndian.Uint32(cmd.Args[i])
+				if addr >= MEM_SIZE {
+					conn.WriteError("ERR memory address out of range")
+					return
+				} else if protected[addr] {
+					conn.WriteError("ERR memory address is write protected")
 					return
 				}
+			}
+		}
 
-				for i := 1; i < len(cmd.Args); i += 2 {
-					switch db {
-					case REGISTER_DB:
-						reg := cmd.Args[i][0]
-
-						// x0 is always 0
-						if reg == 0 {
-							continue
-						} else if reg > 31 {
-							conn.WriteError("ERR register address out of range")
-							return
-						}
-
-						registers[reg] = binary.LittleEndian.Uint32(cmd.Args[2])
-					case MEMORY_DB:
-						addr := binary.LittleEndian.Uint32(cmd.Args[i])
-						if addr > MEM_SIZE {
-							conn.WriteError("ERR memory address out of range")
-							return
-						}
-						memory[addr] = cmd.Args[i+1][0]
-					}
+		if db == REGISTER_DB {
+			registersLock.Lock()
+		}
+		for i := 1; i < len(cmd.Args); i += 2 {
+			switch db {
+			case REGISTER_DB:
+				// x0 is always 0
+				if reg := cmd.Args[i][0]; reg != 0 {
+					registers[reg] = binary.LittleEndian.Uint32(cmd.Args[i+1])
 				}
+			case MEMORY_DB:
+				memory[binary.LittleEndian.Uint32(cmd.Args[i])] = cmd.Args[i+1][0]
+			}
+		}
+		if db == REGISTER_DB {
+			registersLock.Unlock()
+		}
 
-				conn.WriteString("OK")
-			case "mget":
-				if len(cmd.Args) < 2 {
-					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		conn.WriteString("OK")
+	case "mget":
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		conn.WriteArray(len(cmd.Args) - 1)
+		regOut := make([]byte, 4)
+		memOut := make([]byte, 1)
+		for i := 1; i < len(cmd.Args); i++ {
+			switch db {
+			case REGISTER_DB:
+				argInt := cmd.Args[i][0]
+				value := registers[argInt]
+				binary.LittleEndian.PutUint32(regOut, value)
+				conn.WriteBulk(regOut)
+			case MEMORY_DB:
+				argInt := binary.LittleEndian.Uint32(cmd.Args[i])
+				value := memory[argInt]
+
+				memOut[0] = uint8(value)
+				conn.WriteBulk(memOut)
+			}
+		}
+	case "scan":
+		// SCAN cursor [MATCH pattern] [COUNT count]. The cursor is the next key index.
+		// Keys are binary addresses, so MATCH is accepted but ignored.
+		if len(cmd.Args) < 2 || len(cmd.Args)%2 != 0 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		cursor, err := strconv.ParseUint(string(cmd.Args[1]), 10, 32)
+		if err != nil {
+			conn.WriteError("ERR invalid cursor")
+			return
+		}
+
+		count := uint64(DEFAULT_SCAN_COUNT)
+		for i := 2; i < len(cmd.Args); i += 2 {
+			if strings.ToLower(string(cmd.Args[i])) == "count" {
+				count, err = strconv.ParseUint(string(cmd.Args[i+1]), 10, 32)
+				if err != nil || count == 0 {
+					conn.WriteError("ERR value is not an integer or out of range")
 					return
 				}
+			}
+		}
 
-				conn.WriteArray(len(cmd.Args) - 1)
-				regOut := make([]byte, 4)
-				memOut := make([]byte, 1)
-				for i := 1; i < len(cmd.Args); i++ {
-					switch db {
-					case REGISTER_DB:
-						argInt := cmd.Args[i][0]
-						value := registers[argInt]
-						binary.LittleEndian.PutUint32(regOut, value)
-						conn.WriteBulk(regOut)
-					case MEMORY_DB:
-						argInt := binary.LittleEndian.Uint32(cmd.Args[i])
-						value := memory[argInt]
-
-						memOut[0] = uint8(value)
-						conn.WriteBulk(memOut)
-					}
-				}
-			case "scan":
-				conn.WriteArray(2)
-				conn.WriteBulkString("0")
-
-				switch db {
-				case REGISTER_DB:
-					conn.WriteArray(REG_SIZE)
-					out := make([]byte, 1)
-					for i := 0; i < REG_SIZE; i++ {
-						out[0] = uint8(i)
-						conn.WriteBulk(out)
-					}
-				case MEMORY_DB:
-					conn.WriteArray(MEM_SIZE)
-					out := make([]byte, 4)
-					for i := 0; i < MEM_SIZE; i++ {
-						binary.LittleEndian.PutUint32(out, uint32(i))
-						conn.WriteBulk(out)
-					}
-				}
+		var size uint64
+		switch db {
+		case REGISTER_DB:
+			size = REG_SIZE
+		case MEMORY_DB:
+			size = MEM_SIZE
+		}
 
-			case "truncate", "flushdb":
-
-				switch db {
-				case REGISTER_DB:
-					for i := 0; i < 32; i++ {
-						registers[i] = 0
-					}
-				case MEMORY_DB:
-					for i := 0; i < MEM_SIZE; i++ {
-						memory[i] = 0
-					}
-				}
+		start := min(cursor, size)
+		end := min(start+count, size)
+		next := end
+		if end >= size {
+			next = 0
+		}
 
-				conn.WriteString("OK")
+		conn.WriteArray(2)
+		conn.WriteBulkString(strconv.FormatUint(next, 10))
+		conn.WriteArray(int(end - start))
+		switch db {
+		case REGISTER_DB:
+			out := make([]byte, 1)
+			for i := start; i < end; i++ {
+				out[0] = uint8(i)
+				conn.WriteBulk(out)
+			}
+		case MEMORY_DB:
+			out := make([]byte, 4)
+			for i := start; i < end; i++ {
+				binary.LittleEndian.PutUint32(out, uint32(i))
+				conn.WriteBulk(out)
+			}
+		}
+
+	case "dump":
+		// DUMP lists only the non-zero keys as [address, value] integer pairs, so the CPU's footprint
+		// can be seen without scanning the whole keyspace. Not Redis' DUMP <key> serialization.
+		if len(cmd.Args) != 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		switch db {
+		case REGISTER_DB:
+			registersLock.Lock()
+			snapshot := make([]uint32, REG_SIZE)
+			copy(snapshot, registers)
+			registersLock.Unlock()
+
+			writeNonZero(conn, snapshot)
+		case MEMORY_DB:
+			writeNonZero(conn, memory)
+		default:
+			conn.WriteArray(0)
+		}
+	case "protect", "unprotect":
+		// PROTECT <start> <end> makes [start, end) read-only for SET/MSET, e.g. ROM during a run.
+		// UNPROTECT <start> <end> clears a range, UNPROTECT alone clears everything. FLUSHDB still zeroes it all.
+		if db != MEMORY_DB {
+			conn.WriteError("ERR " + strings.ToUpper(name) + " is only supported on memory")
+			return
+		}
+
+		readOnly := name == "protect"
+		start, end := 0, MEM_SIZE
+		if len(cmd.Args) == 3 {
+			var err error
+			start, end, err = parseRange(cmd.Args[1], cmd.Args[2])
+			if err != nil {
+				conn.WriteError("ERR " + err.Error())
+				return
+			}
+		} else if readOnly || len(cmd.Args) != 1 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+
+		for i := start; i < end; i++ {
+			protected[i] = readOnly
+		}
+
+		conn.WriteString("OK")
+	case "cas":
+		// CAS <reg> <expected> <new>, values are 4 byte little endian like SET.
+		// Replies 1 if the register held expected and was swapped, otherwise 0.
+		if len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+			return
+		}
+		if db != REGISTER_DB {
+			conn.WriteError("ERR CAS is only supported on registers")
+			return
+		}
+
+		reg := cmd.Args[1][0]
+		if reg > 31 {
+			conn.WriteError("ERR register address out of range")
+			return
+		} else if len(cmd.Args[2]) != 4 || len(cmd.Args[3]) != 4 {
+			conn.WriteError("ERR CAS values must be 4 bytes")
+			return
+		}
+
+		expected := binary.LittleEndian.Uint32(cmd.Args[2])
+		value := binary.LittleEndian.Uint32(cmd.Args[3])
+
+		registersLock.Lock()
+		swapped := registers[reg] == expected
+		// x0 is always 0, it matches an expected 0 but is never written
+		if swapped && reg != 0 {
+			registers[reg] = value
+		}
+		registersLock.Unlock()
+
+		if swapped {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+	case "truncate", "flushdb":
+
+		switch db {
+		case REGISTER_DB:
+			registersLock.Lock()
+			for i := 0; i < 32; i++ {
+				registers[i] = 0
+			}
+			registersLock.Unlock()
+		case MEMORY_DB:
+			for i := 0; i < MEM_SIZE; i++ {
+				memory[i] = 0
 			}
-		},
-		func(conn redcon.Conn) bool {
-			connToDB[conn.RemoteAddr()] = 0
-			return true
-		},
-		func(conn redcon.Conn, err error) {
-		},
-	)
+		}
+
+		conn.WriteString("OK")
+	}
+}
+
+func writeNonZero[T uint8 | uint32](conn redcon.Conn, values []T) {
+	count := 0
+	for _, value := range values {
+		if value != 0 {
+			count++
+		}
+	}
+
+	conn.WriteArray(count)
+	for addr, value := range values {
+		if value != 0 {
+			conn.WriteArray(2)
+			conn.WriteInt(addr)
+			conn.WriteInt64(int64(value))
+		}
+	}
+}
+
+// parseRange parses a decimal [start, end) memory range, as reported by REGIONS
+func parseRange(startArg []byte, endArg []byte) (int, int, error) {
+	start, err := strconv.Atoi(string(startArg))
 	if err != nil {
-		log.Fatal(err)
+		return 0, 0, fmt.Errorf("invalid range start")
 	}
+	end, err := strconv.Atoi(string(endArg))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid range end")
+	}
+
+	if start < 0 || end > MEM_SIZE || start >= end {
+		return 0, 0, fmt.Errorf("memory range out of bounds")
+	}
+
+	return start, end, nil
+}
+
+func writeRegion(conn redcon.Conn, name string, start int, end int) {
+	conn.WriteArray(3)
+	conn.WriteBulkString(name)
+	conn.WriteInt(start)
+	conn.WriteInt(end)
+}
+
+// writeHello writes the HELLO reply map as a flat RESP2 array
+func writeHello(conn redcon.Conn) {
+	conn.WriteArray(14)
+	conn.WriteBulkString("server")
+	conn.WriteBulkString("redis")
+	conn.WriteBulkString("version")
+	conn.WriteBulkString("7.0.0")
+	conn.WriteBulkString("proto")
+	conn.WriteInt(2)
+	conn.WriteBulkString("id")
+	conn.WriteInt(0)
+	conn.WriteBulkString("mode")
+	conn.WriteBulkString("standalone")
+	conn.WriteBulkString("role")
+	conn.WriteBulkString("master")
+	conn.WriteBulkString("modules")
+	conn.WriteArray(0)
+}
+
+// getInfo returns enough INFO fields for generic Redis tooling to connect
+func getInfo() string {
+	var sb strings.Builder
+	sb.WriteString("# Server\r\n")
+	sb.WriteString("redis_version:7.0.0\r\n")
+	sb.WriteString("redis_mode:standalone\r\n")
+	sb.WriteString("server_name:clickv-mem\r\n")
+	sb.WriteString("\r\n# Keyspace\r\n")
+	fmt.Fprintf(&sb, "db%d:keys=%d,expires=0,avg_ttl=0\r\n", REGISTER_DB, REG_SIZE)
+	fmt.Fprintf(&sb, "db%d:keys=%d,expires=0,avg_ttl=0\r\n", MEMORY_DB, MEM_SIZE)
+
+	return sb.String()
 }
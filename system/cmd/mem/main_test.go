@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+func startTestServer(t *testing.T) string {
+	srv := redcon.NewServer("127.0.0.1:0", handleCommand, acceptConn, closedConn)
+	signal := make(chan error)
+	go srv.ListenServeAndSignal(signal)
+	if err := <-signal; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	return srv.Addr().String()
+}
+
+// sendCommand writes a RESP command and returns the first line of the reply
+func sendCommand(t *testing.T, conn net.Conn, args ...string) string {
+	cmd := []byte{}
+	cmd = redcon.AppendArray(cmd, len(args))
+	for _, arg := range args {
+		cmd = redcon.AppendBulkString(cmd, arg)
+	}
+	_, err := conn.Write(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return line
+}
+
+func connToDBLen() int {
+	connToDBLock.Lock()
+	defer connToDBLock.Unlock()
+	return len(connToDB)
+}
+
+func TestConnToDB_cleared_on_disconnect(t *testing.T) {
+	addr := startTestServer(t)
+
+	for i := 0; i < 20; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reply := sendCommand(t, conn, "select", "1"); reply != "+OK\r\n" {
+			t.Fatalf("expected +OK, got %q", reply)
+		}
+		conn.Close()
+	}
+
+	// closed callbacks run asynchronously once the server notices the disconnect
+	deadline := time.Now().Add(2 * time.Second)
+	for connToDBLen() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected connToDB to be empty after disconnects, has %d entries", connToDBLen())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHello(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if reply := sendCommand(t, conn, "hello", "3"); reply != "-NOPROTO unsupported protocol version\r\n" {
+		t.Fatalf("expected NOPROTO for RESP3, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "hello", "2"); reply != "*14\r\n" {
+		t.Fatalf("expected a 14 element reply for RESP2, got %q", reply)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	requirePass = "clickv"
+	defer func() { requirePass = "" }()
+
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if reply := sendCommand(t, conn, "ping"); reply != "+PONG\r\n" {
+		t.Fatalf("expected PING to be allowed before AUTH, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "select", "1"); reply != "-NOAUTH Authentication required.\r\n" {
+		t.Fatalf("expected NOAUTH, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "auth", "wrong"); reply[:10] != "-WRONGPASS" {
+		t.Fatalf("expected WRONGPASS, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "auth", "clickv"); reply != "+OK\r\n" {
+		t.Fatalf("expected AUTH to succeed, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "select", "1"); reply != "+OK\r\n" {
+		t.Fatalf("expected SELECT after AUTH to succeed, got %q", reply)
+	}
+}
+
+func TestDBSize(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if reply := sendCommand(t, conn, "dbsize"); reply != ":32\r\n" {
+		t.Fatalf("expected register db size of 32, got %q", reply)
+	}
+	sendCommand(t, conn, "select", "1")
+	if reply := sendCommand(t, conn, "dbsize"); reply != ":3872\r\n" {
+		t.Fatalf("expected memory db size of 3872, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "regions"); reply != "*3\r\n" {
+		t.Fatalf("expected 3 memory regions, got %q", reply)
+	}
+}
+
+func TestScan_paginates(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Walk the register db 12 keys at a time, counting the keys returned
+	cursor := "0"
+	total := 0
+	for calls := 0; ; calls++ {
+		if calls > REG_SIZE {
+			t.Fatalf("scan did not finish")
+		}
+
+		cmd := redcon.AppendArray(nil, 4)
+		for _, arg := range []string{"scan", cursor, "count", "12"} {
+			cmd = redcon.AppendBulkString(cmd, arg)
+		}
+		_, err := conn.Write(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// *2, $len, cursor, *n, then n bulk strings
+		lines := readLines(t, reader, 4)
+		cursor = strings.TrimSpace(lines[2])
+		var n int
+		fmt.Sscanf(lines[3], "*%d", &n)
+		for i := 0; i < n; i++ {
+			readBulk(t, reader)
+		}
+		total += n
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if total != REG_SIZE {
+		t.Fatalf("expected %d keys across all pages, got %d", REG_SIZE, total)
+	}
+}
+
+func readLines(t *testing.T, reader *bufio.Reader, n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines[i] = line
+	}
+	return lines
+}
+
+// readBulk reads one bulk string by its length, keys are binary and may contain \r\n
+func readBulk(t *testing.T, reader *bufio.Reader) []byte {
+	var size int
+	fmt.Sscanf(readLines(t, reader, 1)[0], "$%d", &size)
+	bulk := make([]byte, size+2)
+	_, err := io.ReadFull(reader, bulk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bulk[:size]
+}
+
+func uint32Arg(value uint32) string {
+	return string([]byte{byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24)})
+}
+
+func TestCAS(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reg := string([]byte{5})
+	sendCommand(t, conn, "set", reg, uint32Arg(7))
+
+	if reply := sendCommand(t, conn, "cas", reg, uint32Arg(8), uint32Arg(9)); reply != ":0\r\n" {
+		t.Fatalf("expected CAS with a stale value to fail, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "cas", reg, uint32Arg(7), uint32Arg(9)); reply != ":1\r\n" {
+		t.Fatalf("expected CAS with the current value to swap, got %q", reply)
+	}
+	if registers[5] != 9 {
+		t.Fatalf("expected register 5 to be 9 after CAS, got %d", registers[5])
+	}
+
+	if reply := sendCommand(t, conn, "cas", string([]byte{0}), uint32Arg(0), uint32Arg(1)); reply != ":1\r\n" || registers[0] != 0 {
+		t.Fatalf("expected CAS on x0 to match 0 without writing, got %q with x0=%d", reply, registers[0])
+	}
+	sendCommand(t, conn, "flushdb")
+
+	sendCommand(t, conn, "select", "1")
+	if reply := sendCommand(t, conn, "cas", uint32Arg(0), uint32Arg(0), uint32Arg(1)); reply != "-ERR CAS is only supported on registers\r\n" {
+		t.Fatalf("expected CAS on memory to be rejected, got %q", reply)
+	}
+}
+
+func TestMSet_registers(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	defer sendCommand(t, conn, "flushdb")
+
+	regs := []byte{1, 2, 3, 31}
+	values := []uint32{11, 0x12345678, 0, 0xFFFFFFFF}
+	args := []string{"mset"}
+	for i, reg := range regs {
+		args = append(args, string([]byte{reg}), uint32Arg(values[i]))
+	}
+	if reply := sendCommand(t, conn, args...); reply != "+OK\r\n" {
+		t.Fatalf("expected MSET to succeed, got %q", reply)
+	}
+
+	// Each register takes its own value, not the first pair's
+	for i, reg := range regs {
+		_, err := conn.Write(redcon.AppendBulkString(redcon.AppendBulkString(redcon.AppendArray(nil, 2), "get"), string([]byte{reg})))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := string(readBulk(t, reader)); value != fmt.Sprint(values[i]) {
+			t.Fatalf("expected register %d to be %d, got %s", reg, values[i], value)
+		}
+	}
+}
+
+func TestDump_non_zero(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	sendCommand(t, conn, "select", "1")
+	sendCommand(t, conn, "set", uint32Arg(ROM_SIZE), "\x2a")
+	sendCommand(t, conn, "set", uint32Arg(MEM_SIZE-1), "\x07")
+	defer sendCommand(t, conn, "flushdb")
+
+	_, err = conn.Write(redcon.AppendBulkString(redcon.AppendArray(nil, 1), "dump"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// *2, then *2 :addr :value per pair
+	lines := readLines(t, reader, 7)
+	expected := []string{"*2", "*2", fmt.Sprintf(":%d", ROM_SIZE), ":42", "*2", fmt.Sprintf(":%d", MEM_SIZE-1), ":7"}
+	for i, line := range lines {
+		if strings.TrimSpace(line) != expected[i] {
+			t.Fatalf("expected dump %v, got %q", expected, lines)
+		}
+	}
+}
+
+func TestProtect(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sendCommand(t, conn, "select", "1")
+	defer sendCommand(t, conn, "flushdb")
+
+	if reply := sendCommand(t, conn, "protect", "0", fmt.Sprint(ROM_SIZE)); reply != "+OK\r\n" {
+		t.Fatalf("expected PROTECT to succeed, got %q", reply)
+	}
+	defer sendCommand(t, conn, "unprotect")
+
+	if reply := sendCommand(t, conn, "set", uint32Arg(ROM_SIZE-1), "\x01"); reply != "-ERR memory address is write protected\r\n" {
+		t.Fatalf("expected SET into ROM to be rejected, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "mset", uint32Arg(ROM_SIZE), "\x01", uint32Arg(0), "\x01"); reply != "-ERR memory address is write protected\r\n" {
+		t.Fatalf("expected MSET into ROM to be rejected, got %q", reply)
+	}
+	if memory[ROM_SIZE] != 0 {
+		t.Fatalf("expected the rejected MSET to leave RAM untouched, got %d at ROM_SIZE", memory[ROM_SIZE])
+	}
+	if reply := sendCommand(t, conn, "set", uint32Arg(ROM_SIZE), "\x01"); reply != "+OK\r\n" {
+		t.Fatalf("expected SET into RAM to succeed, got %q", reply)
+	}
+
+	if reply := sendCommand(t, conn, "protect", "10", "5"); reply != "-ERR memory range out of bounds\r\n" {
+		t.Fatalf("expected an inverted range to be rejected, got %q", reply)
+	}
+
+	if reply := sendCommand(t, conn, "unprotect", "0", "16"); reply != "+OK\r\n" {
+		t.Fatalf("expected UNPROTECT to succeed, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "set", uint32Arg(0), "\x01"); reply != "+OK\r\n" {
+		t.Fatalf("expected SET after UNPROTECT to succeed, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "set", uint32Arg(16), "\x01"); reply != "-ERR memory address is write protected\r\n" {
+		t.Fatalf("expected the rest of ROM to stay protected, got %q", reply)
+	}
+}
+
+func TestSet_out_of_range(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sendCommand(t, conn, "select", "1")
+
+	for _, args := range [][]string{
+		{"set", uint32Arg(MEM_SIZE), "\x01"},
+		{"mset", uint32Arg(MEM_SIZE), "\x01"},
+		{"get", uint32Arg(MEM_SIZE)},
+	} {
+		if reply := sendCommand(t, conn, args...); reply != "-ERR memory address out of range\r\n" {
+			t.Fatalf("expected %s at MEM_SIZE to be rejected, got %q", args[0], reply)
+		}
+	}
+
+	// The connection survived
+	if reply := sendCommand(t, conn, "ping"); reply != "+PONG\r\n" {
+		t.Fatalf("expected PONG, got %q", reply)
+	}
+}
+
+// redis-cli sends COMMAND on connect and INFO for server details
+func TestCommandAndInfo(t *testing.T) {
+	addr := startTestServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if reply := sendCommand(t, conn, "command"); reply != "*0\r\n" {
+		t.Fatalf("expected an empty array for COMMAND, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "command", "docs"); reply != "*0\r\n" {
+		t.Fatalf("expected an empty array for COMMAND DOCS, got %q", reply)
+	}
+	if reply := sendCommand(t, conn, "command", "count"); reply != ":0\r\n" {
+		t.Fatalf("expected 0 for COMMAND COUNT, got %q", reply)
+	}
+
+	cmd := redcon.AppendArray(nil, 1)
+	cmd = redcon.AppendBulkString(cmd, "info")
+	if _, err := conn.Write(cmd); err != nil {
+		t.Fatal(err)
+	}
+	info := string(readBulk(t, bufio.NewReader(conn)))
+	if !strings.Contains(info, "redis_version:") {
+		t.Fatalf("expected INFO to be a bulk string with redis_version, got %q", info)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"clickhouse.com/clickv/internal/db"
+)
+
+/**
+ * Compares two flat memory dumps (e.g. from memdump before and after a CPU change)
+ * and prints each range of addresses that differs. Identical regions are skipped.
+ * Exits 1 when the dumps differ.
+ */
+
+func main() {
+	start := flag.Uint("start", 0, "address of the first byte in both dumps (memdump's -start)")
+	maxRanges := flag.Int("max", 50, "differing ranges to print (0 = all)")
+	maxBytes := flag.Int("bytes", 16, "bytes of each range to print")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		fmt.Println("usage: memdiff [flags] <old.bin> <new.bin>")
+		os.Exit(2)
+	}
+
+	before, err := os.ReadFile(flag.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	after, err := os.ReadFile(flag.Arg(1))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	diffs := db.DiffMemory(before, after)
+	differing := 0
+	for i, diff := range diffs {
+		differing += diff.Len()
+		if *maxRanges > 0 && i >= *maxRanges {
+			continue
+		}
+
+		first := uint32(*start) + diff.Start
+		fmt.Printf("0x%08x-0x%08x (%d bytes)\n", first, first+uint32(diff.Len())-1, diff.Len())
+		fmt.Printf("  old: %s\n", formatBytes(diff.Old, *maxBytes))
+		fmt.Printf("  new: %s\n", formatBytes(diff.New, *maxBytes))
+	}
+	if *maxRanges > 0 && len(diffs) > *maxRanges {
+		fmt.Printf("... %d more ranges\n", len(diffs)-*maxRanges)
+	}
+
+	fmt.Printf("%d ranges, %d bytes differ (%d vs %d bytes compared)\n", len(diffs), differing, len(before), len(after))
+	if len(diffs) > 0 {
+		os.Exit(1)
+	}
+}
+
+func formatBytes(b []byte, limit int) string {
+	if len(b) == 0 {
+		return "(past end of dump)"
+	}
+	if len(b) > limit {
+		return fmt.Sprintf("% x ...", b[:limit])
+	}
+	return fmt.Sprintf("% x", b)
+}
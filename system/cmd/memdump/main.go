@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"clickhouse.com/clickv/internal/db"
+)
+
+/**
+ * Dumps clickv.memory to a flat .bin file, byte N of the file is address start+N.
+ * Useful for capturing machine state after N cycles.
+ */
+
+func main() {
+	output := flag.String("o", "memory.bin", "output file")
+	start := flag.Uint("start", 0, "first address to dump")
+	length := flag.Uint("len", 0, "number of bytes to dump (0 = up to the end of memory)")
+	flag.Parse()
+
+	conn, err := db.GetClickHouseConnection()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	if *length == 0 {
+		size, err := db.ReadClickHouseMemorySize(ctx, conn)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if uint32(*start) < size {
+			*length = uint(size - uint32(*start))
+		}
+	}
+
+	begin := time.Now()
+	memory, err := db.ReadClickHouseMemoryRange(ctx, conn, uint32(*start), uint32(*length))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err = os.WriteFile(*output, memory, 0666)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("dumped %d bytes from 0x%08x to %s in %s\n", len(memory), *start, *output, time.Since(begin))
+}
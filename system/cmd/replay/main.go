@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"clickhouse.com/clickv/internal/clickos"
+)
+
+/**
+ * Runs a session log recorded with `clickos-server -record` back through MuxCall, in order,
+ * and reports every response that differs from the recorded one.
+ * Run it from the same working directory with the same files, and the same -random-seed and
+ * -libc-stubs the server had. Sockets are re-dialed, so datagrams read from them won't match.
+ */
+
+func main() {
+	flag.BoolVar(&clickos.LibcStubs, "libc-stubs", false, "answer libc startup syscalls, as the recording server did")
+	randomSeed := flag.Int64("random-seed", 0, "GETRANDOM seed the recording server used")
+	stopOnMismatch := flag.Bool("stop", false, "stop at the first mismatch")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Println("usage: replay [flags] <session log>")
+		os.Exit(2)
+	}
+
+	if *randomSeed != 0 {
+		clickos.SeedRandom(*randomSeed)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	defer clickos.CloseAllDescriptors()
+
+	reader := bufio.NewReader(file)
+	replayed, mismatches := 0, 0
+	for {
+		recorded, err := clickos.ReadRecord(reader)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			fmt.Printf("record %d: %v\n", replayed, err)
+			os.Exit(1)
+		}
+
+		req := &clickos.SyscallRequest{SyscallN: recorded.SyscallN, Bytes: recorded.Request}
+		resp, err := clickos.MuxCall(req)
+		got := clickos.NewRecord(req, resp, err)
+		if !got.Equal(recorded) {
+			mismatches++
+			fmt.Printf("record %d differs\n  recorded: %s\n  replayed: %s\n", replayed, recorded.DebugString(), got.DebugString())
+			if err != nil {
+				fmt.Printf("  error: %v\n", err)
+			}
+			if *stopOnMismatch {
+				os.Exit(1)
+			}
+		}
+		replayed++
+	}
+
+	fmt.Printf("replayed %d syscalls, %d differed\n", replayed, mismatches)
+	if mismatches > 0 {
+		os.Exit(1)
+	}
+}
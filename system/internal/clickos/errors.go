@@ -0,0 +1,23 @@
+package clickos
+
+import "errors"
+
+/**
+ * Errors returned by MuxCall, so the server can tell whose fault a failed call was.
+ * Check them with errors.Is, the returned errors wrap them with details.
+ */
+
+// The request is the client's fault, running it again gives the same error
+var ErrUnknownSyscall = errors.New("unknown syscall number")
+var ErrShortPayload = errors.New("payload too short")
+var ErrBadPayload = errors.New("malformed payload")
+var ErrBadFd = errors.New("bad file descriptor")
+
+// The host failed (file system, network, ClickHouse), a retry may succeed
+var ErrIO = errors.New("I/O error")
+
+// IsClientError reports whether err was caused by the request rather than the host
+func IsClientError(err error) bool {
+	return errors.Is(err, ErrUnknownSyscall) || errors.Is(err, ErrShortPayload) ||
+		errors.Is(err, ErrBadPayload) || errors.Is(err, ErrBadFd)
+}
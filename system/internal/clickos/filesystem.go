@@ -0,0 +1,169 @@
+package clickos
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+/**
+ * Filesystem syscalls for guest save management. Paths are relative to the server's working directory, same as OPEN.
+ * Since these create, delete, and move files, absolute paths and paths with a ".." element are refused with EACCES.
+ * Errors the guest can act on (missing file, already exists...) are returned as a Linux errno in Status.
+ */
+
+// errPathEscapes maps to EACCES through toErrno
+var errPathEscapes = fmt.Errorf("path leaves the working directory: %w", fs.ErrPermission)
+
+// checkGuestPath refuses paths that could reach outside the server's working directory
+func checkGuestPath(pathName string) error {
+	if filepath.IsAbs(pathName) {
+		return errPathEscapes
+	}
+	for _, element := range strings.Split(filepath.ToSlash(pathName), "/") {
+		if element == ".." {
+			return errPathEscapes
+		}
+	}
+
+	return nil
+}
+
+// toErrno maps a host filesystem error to the Linux errno the guest expects
+func toErrno(err error) (int32, bool) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return ERRNO_ENOENT, true
+	case errors.Is(err, fs.ErrExist):
+		return ERRNO_EEXIST, true
+	case errors.Is(err, fs.ErrPermission):
+		return ERRNO_EACCES, true
+	case errors.Is(err, syscall.ENOTDIR):
+		return ERRNO_ENOTDIR, true
+	case errors.Is(err, syscall.EISDIR):
+		return ERRNO_EISDIR, true
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return ERRNO_ENOTEMPTY, true
+	default:
+		return 0, false
+	}
+}
+
+func filesystemResponse(syscallN uint32, err error) (*SyscallResponse, error) {
+	if err == nil {
+		return &SyscallResponse{
+			SyscallN: syscallN,
+			Status:   0,
+		}, nil
+	}
+
+	errno, ok := toErrno(err)
+	if !ok {
+		return nil, fmt.Errorf("%s failed: %w: %w", SyscallToName(syscallN), ErrIO, err)
+	}
+
+	return &SyscallResponse{
+		SyscallN: syscallN,
+		Status:   errno,
+	}, nil
+}
+
+type mkdirCall struct {
+	pathName string
+	mode     uint32
+}
+
+func decodeMkdirCall(bytes []byte) (mkdirCall, error) {
+	offset := 0
+	pathName, terminated := ReadCStringN(bytes, MAX_PATH_LEN)
+	if !terminated {
+		return mkdirCall{}, fmt.Errorf("invalid mkdir call: %w: path is not NUL terminated", ErrBadPayload)
+	}
+	offset += len(pathName) + 1
+	if len(bytes) < offset+4 {
+		return mkdirCall{}, fmt.Errorf("invalid mkdir call: %w", ErrShortPayload)
+	}
+
+	mode := binary.LittleEndian.Uint32(bytes[offset : offset+4])
+	offset += 4
+
+	return mkdirCall{pathName, mode}, nil
+}
+
+func handleMkdirCall(call mkdirCall) (*SyscallResponse, error) {
+	err := checkGuestPath(call.pathName)
+	if err != nil {
+		return filesystemResponse(SYSCALL_MKDIR, err)
+	}
+
+	err = os.Mkdir(call.pathName, fs.FileMode(call.mode)&fs.ModePerm)
+	return filesystemResponse(SYSCALL_MKDIR, err)
+}
+
+type unlinkCall struct {
+	pathName string
+}
+
+func decodeUnlinkCall(bytes []byte) (unlinkCall, error) {
+	pathName, terminated := ReadCStringN(bytes, MAX_PATH_LEN)
+	if !terminated {
+		return unlinkCall{}, fmt.Errorf("invalid unlink call: %w: path is not NUL terminated", ErrBadPayload)
+	}
+
+	return unlinkCall{pathName}, nil
+}
+
+// handleUnlinkCall removes files only, like unlink(2). Directories return EISDIR.
+func handleUnlinkCall(call unlinkCall) (*SyscallResponse, error) {
+	err := checkGuestPath(call.pathName)
+	if err != nil {
+		return filesystemResponse(SYSCALL_UNLINK, err)
+	}
+
+	info, err := os.Lstat(call.pathName)
+	if err == nil && info.IsDir() {
+		return filesystemResponse(SYSCALL_UNLINK, syscall.EISDIR)
+	} else if err != nil {
+		return filesystemResponse(SYSCALL_UNLINK, err)
+	}
+
+	err = os.Remove(call.pathName)
+	return filesystemResponse(SYSCALL_UNLINK, err)
+}
+
+type renameCall struct {
+	oldPath string
+	newPath string
+}
+
+func decodeRenameCall(bytes []byte) (renameCall, error) {
+	offset := 0
+	oldPath, terminated := ReadCStringN(bytes[offset:], MAX_PATH_LEN)
+	if !terminated {
+		return renameCall{}, fmt.Errorf("invalid rename call: %w: old path is not NUL terminated", ErrBadPayload)
+	}
+	offset += len(oldPath) + 1
+
+	newPath, terminated := ReadCStringN(bytes[offset:], MAX_PATH_LEN)
+	if !terminated {
+		return renameCall{}, fmt.Errorf("invalid rename call: %w: new path is not NUL terminated", ErrBadPayload)
+	}
+	offset += len(newPath) + 1
+
+	return renameCall{oldPath, newPath}, nil
+}
+
+func handleRenameCall(call renameCall) (*SyscallResponse, error) {
+	err := errors.Join(checkGuestPath(call.oldPath), checkGuestPath(call.newPath))
+	if err != nil {
+		return filesystemResponse(SYSCALL_RENAME, err)
+	}
+
+	err = os.Rename(call.oldPath, call.newPath)
+	return filesystemResponse(SYSCALL_RENAME, err)
+}
@@ -14,19 +14,91 @@ func ReadCString(input []byte) string {
 	return string(input[:n])
 }
 
+// ReadCStringN reads at most max bytes looking for a NUL terminator.
+// The bool reports whether a terminator was actually found, rather than running out of input or hitting max.
+func ReadCStringN(input []byte, max int) (string, bool) {
+	n := 0
+	for n < len(input) && n < max && input[n] != 0 {
+		n++
+	}
+	return string(input[:n]), n < len(input) && n < max
+}
+
+// Payloads up to this size are printed as a plain decimal list
+const shortPayloadSize = 8
+
+// formatPayload keeps tiny payloads short, and hex dumps anything larger so paths and binary data are readable.
+func formatPayload(payload []byte) string {
+	if len(payload) <= shortPayloadSize {
+		return fmt.Sprintf("%v", payload)
+	}
+
+	return fmt.Sprintf("(%d bytes)\n%s", len(payload), HexDump(payload))
+}
+
+// HexDump formats bytes as 16-byte lines of offset, hex, and printable ASCII.
+func HexDump(input []byte) string {
+	var sb strings.Builder
+	for offset := 0; offset < len(input); offset += 16 {
+		line := input[offset:min(offset+16, len(input))]
+
+		fmt.Fprintf(&sb, "%08x  ", offset)
+		for i := 0; i < 16; i++ {
+			if i < len(line) {
+				fmt.Fprintf(&sb, "%02x ", line[i])
+			} else {
+				sb.WriteString("   ")
+			}
+			if i == 7 {
+				sb.WriteString(" ")
+			}
+		}
+
+		sb.WriteString(" |")
+		for _, b := range line {
+			if b >= 0x20 && b < 0x7f {
+				sb.WriteByte(b)
+			} else {
+				sb.WriteByte('.')
+			}
+		}
+		sb.WriteString("|\n")
+	}
+
+	return sb.String()
+}
+
+// ParseInputTSV parses "syscall\t[bytes]", optionally followed by "\trequest_id" when sent by a client that retries.
 func ParseInputTSV(input string) (*SyscallRequest, error) {
 	parts := strings.Split(input, "\t")
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid args")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("%w: expected 2 or 3 tab separated columns", ErrBadPayload)
 	}
 
-	syscallNum64, err := strconv.ParseUint(parts[0], 10, 32)
+	syscallNum64, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 32)
 	if err != nil {
-		return nil, fmt.Errorf("invalid number format for syscall num: %v", err)
+		return nil, fmt.Errorf("%w: invalid number format for syscall num: %v", ErrBadPayload, err)
 	}
 	syscallNum := uint32(syscallNum64)
 
-	byteArrayStr := strings.Trim(parts[1], "[]")
+	var requestID uint64
+	if len(parts) == 3 {
+		requestID, err = strconv.ParseUint(strings.TrimSpace(parts[2]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number format for request id: %v", ErrBadPayload, err)
+		}
+	}
+
+	// "[]" (or "[ ]") must be an empty payload, splitting it would give one empty element
+	byteArrayStr := strings.Trim(strings.TrimSpace(parts[1]), "[]")
+	if strings.TrimSpace(byteArrayStr) == "" {
+		return &SyscallRequest{
+			SyscallN: syscallNum,
+			Bytes:    []byte{},
+			ID:       requestID,
+		}, nil
+	}
+
 	byteStrArray := strings.Split(byteArrayStr, ",")
 	bytes := make([]byte, len(byteStrArray))
 
@@ -37,7 +109,7 @@ func ParseInputTSV(input string) (*SyscallRequest, error) {
 
 		byte64, err := strconv.ParseUint(strings.TrimSpace(byteStr), 10, 8)
 		if err != nil {
-			return nil, fmt.Errorf("invalid byte array element format: %v", err)
+			return nil, fmt.Errorf("%w: invalid byte array element format: %v", ErrBadPayload, err)
 		}
 		bytes[i] = byte(byte64)
 	}
@@ -45,5 +117,77 @@ func ParseInputTSV(input string) (*SyscallRequest, error) {
 	return &SyscallRequest{
 		SyscallN: syscallNum,
 		Bytes:    bytes,
+		ID:       requestID,
 	}, nil
 }
+
+// FrameResponse prefixes a serialized response with "request_id\t", so a client can tell a late answer
+// to an earlier attempt from the answer to its current request. Responses to requests without an id are sent bare.
+func FrameResponse(id uint64, resp []byte) []byte {
+	if id == 0 {
+		return resp
+	}
+
+	framed := strconv.AppendUint(nil, id, 10)
+	framed = append(framed, '\t')
+	return append(framed, resp...)
+}
+
+// ParseResponseFrame splits a response from FrameResponse into its request id (0 if none) and the serialized response.
+func ParseResponseFrame(frame string) (uint64, string, error) {
+	idStr, resp, found := strings.Cut(frame, "\t")
+	if !found {
+		return 0, frame, nil
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: invalid number format for response id: %v", ErrBadPayload, err)
+	}
+
+	return id, resp, nil
+}
+
+// Room left in each datagram for the "seq/total\t" chunk header
+const chunkHeaderSize = 32
+
+// ChunkResponse splits a framed response into datagrams of at most MaxDatagramSize, each prefixed with
+// "seq/total\t". The client only accepts a response once it has every chunk in order.
+func ChunkResponse(resp []byte) [][]byte {
+	size := MaxDatagramSize - chunkHeaderSize
+	total := max(1, (len(resp)+size-1)/size)
+
+	chunks := make([][]byte, total)
+	for seq := range chunks {
+		body := resp[min(seq*size, len(resp)):min((seq+1)*size, len(resp))]
+		chunk := fmt.Appendf(nil, "%d/%d\t", seq, total)
+		chunks[seq] = append(chunk, body...)
+	}
+	return chunks
+}
+
+// ParseChunk splits a datagram from ChunkResponse into its sequence number, chunk count, and body.
+func ParseChunk(datagram []byte) (int, int, []byte, error) {
+	header, body, found := strings.Cut(string(datagram), "\t")
+	if !found {
+		return 0, 0, nil, fmt.Errorf("%w: response chunk has no header", ErrBadPayload)
+	}
+
+	seqStr, totalStr, found := strings.Cut(header, "/")
+	if !found {
+		return 0, 0, nil, fmt.Errorf("%w: invalid response chunk header %q", ErrBadPayload, header)
+	}
+	seq, err := strconv.Atoi(seqStr)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("%w: invalid number format for chunk sequence: %v", ErrBadPayload, err)
+	}
+	total, err := strconv.Atoi(totalStr)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("%w: invalid number format for chunk count: %v", ErrBadPayload, err)
+	}
+	if seq < 0 || seq >= total {
+		return 0, 0, nil, fmt.Errorf("%w: chunk %d out of range for %d chunks", ErrBadPayload, seq, total)
+	}
+
+	return seq, total, []byte(body), nil
+}
@@ -0,0 +1,137 @@
+package clickos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/**
+ * Session logs for replaying syscalls without UDP or a guest.
+ * Each record is a little-endian frame:
+ *   syscall_n (4), failed (1), status (4), request length (4), request, response length (4), response
+ * A failed call (MuxCall returned an error) has status -1 and no response bytes, like the server's error response.
+ */
+
+// Frames larger than this are treated as a corrupt log rather than allocated
+const maxRecordPayload = 16 << 20
+
+type Record struct {
+	SyscallN uint32
+	Request  []byte
+	Failed   bool
+	Status   int32
+	Response []byte
+}
+
+func NewRecord(req *SyscallRequest, resp *SyscallResponse, err error) Record {
+	rec := Record{
+		SyscallN: req.SyscallN,
+		Request:  req.Bytes,
+	}
+	if err != nil || resp == nil {
+		rec.Failed = true
+		rec.Status = -1
+		return rec
+	}
+
+	rec.Status = resp.Status
+	rec.Response = resp.Bytes
+	return rec
+}
+
+func (r Record) Equal(other Record) bool {
+	return r.SyscallN == other.SyscallN &&
+		r.Failed == other.Failed &&
+		r.Status == other.Status &&
+		bytes.Equal(r.Request, other.Request) &&
+		bytes.Equal(r.Response, other.Response)
+}
+
+func (r Record) DebugString() string {
+	if r.Failed {
+		return fmt.Sprintf("syscall: %s (%d), failed", SyscallToName(r.SyscallN), r.SyscallN)
+	}
+
+	return fmt.Sprintf("syscall: %s (%d), status: %d, bytes: %s", SyscallToName(r.SyscallN), r.SyscallN, r.Status, formatPayload(r.Response))
+}
+
+func WriteRecord(w io.Writer, r Record) error {
+	frame := binary.LittleEndian.AppendUint32(nil, r.SyscallN)
+	if r.Failed {
+		frame = append(frame, 1)
+	} else {
+		frame = append(frame, 0)
+	}
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(r.Status))
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(r.Request)))
+	frame = append(frame, r.Request...)
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(r.Response)))
+	frame = append(frame, r.Response...)
+
+	_, err := w.Write(frame)
+	if err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+
+	return nil
+}
+
+// ReadRecord returns io.EOF at the end of the log, and io.ErrUnexpectedEOF if the last record was cut short.
+func ReadRecord(r io.Reader) (Record, error) {
+	header := make([]byte, 13)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return Record{}, err
+	}
+
+	rec := Record{
+		SyscallN: binary.LittleEndian.Uint32(header[0:4]),
+		Failed:   header[4] != 0,
+		Status:   int32(binary.LittleEndian.Uint32(header[5:9])),
+	}
+
+	rec.Request, err = readRecordPayload(r, binary.LittleEndian.Uint32(header[9:13]))
+	if err != nil {
+		return Record{}, err
+	}
+
+	var responseLen [4]byte
+	_, err = io.ReadFull(r, responseLen[:])
+	if err != nil {
+		return Record{}, noEOF(err)
+	}
+	rec.Response, err = readRecordPayload(r, binary.LittleEndian.Uint32(responseLen[:]))
+	if err != nil {
+		return Record{}, err
+	}
+
+	return rec, nil
+}
+
+func readRecordPayload(r io.Reader, length uint32) ([]byte, error) {
+	if length > maxRecordPayload {
+		return nil, fmt.Errorf("record payload of %d bytes is too large", length)
+	}
+	if length == 0 {
+		return nil, nil
+	}
+
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	if err != nil {
+		return nil, noEOF(err)
+	}
+
+	return payload, nil
+}
+
+// Only a missing header is a clean end of log
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -2,27 +2,86 @@ package clickos
 
 import (
 	"bytes"
+	cryptorand "crypto/rand"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"io"
+	"math/rand"
 	"net"
 	"os"
+	"sort"
 	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"clickhouse.com/clickv/internal/logger"
 )
 
+// MaxDatagramSize is the largest UDP payload sent between the ClickOS client and server.
+// Serialized responses larger than this are split across datagrams, see ChunkResponse.
+const MaxDatagramSize = 8192
+
 const SYSCALL_FAILED uint32 = 0xDEAD
 const SYSCALL_RESET uint32 = 0
+
+// Handled entirely in SQL (clickv.ins_ecall_print / clickv.ins_ecall_draw), never forwarded to ClickOS.
+// Listed here so the guest numbering has a single source of truth.
+const SYSCALL_PRINT uint32 = 1
+const SYSCALL_DRAW uint32 = 2
+
 const SYSCALL_OPEN uint32 = 10
 const SYSCALL_CLOSE uint32 = 11
 const SYSCALL_SEEK uint32 = 12
 const SYSCALL_READ uint32 = 13
 const SYSCALL_WRITE uint32 = 14
 const SYSCALL_SOCKET uint32 = 15
+const SYSCALL_WRITEV uint32 = 16
+const SYSCALL_PREAD uint32 = 17
+const SYSCALL_FTRUNCATE uint32 = 18
+const SYSCALL_MKDIR uint32 = 19
+const SYSCALL_UNLINK uint32 = 20
+const SYSCALL_RENAME uint32 = 21
+const SYSCALL_FDLIST uint32 = 22
+const SYSCALL_CAPABILITIES uint32 = 23
+
+// Linux RISC-V ioctl. Only terminal queries on stdin/stdout/stderr are answered.
+const SYSCALL_IOCTL uint32 = 29
+
+// Linux RISC-V getrandom. Bytes come from crypto/rand unless SeedRandom was called.
+const SYSCALL_GETRANDOM uint32 = 278
+
+// Linux RISC-V syscall numbers issued by libc during startup.
+// These are stubbed with constant answers when LibcStubs is enabled.
+const SYSCALL_SET_TID_ADDRESS uint32 = 96
+const SYSCALL_GETPID uint32 = 172
+const SYSCALL_GETPPID uint32 = 173
+const SYSCALL_GETUID uint32 = 174
+const SYSCALL_GETEUID uint32 = 175
+const SYSCALL_GETGID uint32 = 176
+const SYSCALL_GETEGID uint32 = 177
+const SYSCALL_GETTID uint32 = 178
+
+// LibcStubs enables the libc startup stubs. Off by default to keep the minimal syscall set.
+var LibcStubs = false
+
+// Errors returned to the guest as a negative Status (a0), matching Linux errno values
+const ERRNO_ENOENT int32 = -2
+const ERRNO_EACCES int32 = -13
+const ERRNO_EEXIST int32 = -17
+const ERRNO_ENOTDIR int32 = -20
+const ERRNO_EISDIR int32 = -21
+const ERRNO_EINVAL int32 = -22
+const ERRNO_ENOTTY int32 = -25
+const ERRNO_ENOTEMPTY int32 = -39
 
 func SyscallToName(syscallN uint32) string {
 	switch syscallN {
 	case SYSCALL_RESET:
 		return "RESET"
+	case SYSCALL_PRINT:
+		return "PRINT"
+	case SYSCALL_DRAW:
+		return "DRAW"
 	case SYSCALL_OPEN:
 		return "OPEN"
 	case SYSCALL_CLOSE:
@@ -35,6 +94,42 @@ func SyscallToName(syscallN uint32) string {
 		return "WRITE"
 	case SYSCALL_SOCKET:
 		return "SOCKET"
+	case SYSCALL_WRITEV:
+		return "WRITEV"
+	case SYSCALL_PREAD:
+		return "PREAD"
+	case SYSCALL_FTRUNCATE:
+		return "FTRUNCATE"
+	case SYSCALL_MKDIR:
+		return "MKDIR"
+	case SYSCALL_UNLINK:
+		return "UNLINK"
+	case SYSCALL_RENAME:
+		return "RENAME"
+	case SYSCALL_FDLIST:
+		return "FDLIST"
+	case SYSCALL_CAPABILITIES:
+		return "CAPABILITIES"
+	case SYSCALL_IOCTL:
+		return "IOCTL"
+	case SYSCALL_GETRANDOM:
+		return "GETRANDOM"
+	case SYSCALL_SET_TID_ADDRESS:
+		return "SET_TID_ADDRESS"
+	case SYSCALL_GETPID:
+		return "GETPID"
+	case SYSCALL_GETPPID:
+		return "GETPPID"
+	case SYSCALL_GETUID:
+		return "GETUID"
+	case SYSCALL_GETEUID:
+		return "GETEUID"
+	case SYSCALL_GETGID:
+		return "GETGID"
+	case SYSCALL_GETEGID:
+		return "GETEGID"
+	case SYSCALL_GETTID:
+		return "GETTID"
 	case SYSCALL_FAILED:
 		return "FAILED"
 	default:
@@ -45,10 +140,11 @@ func SyscallToName(syscallN uint32) string {
 type SyscallRequest struct {
 	SyscallN uint32
 	Bytes    []byte
+	ID       uint64 // set by the client so a retried request can be recognized, 0 if not sent
 }
 
 func (r *SyscallRequest) DebugString() string {
-	return fmt.Sprintf("syscall: %s (%d), bytes: %v", SyscallToName(r.SyscallN), r.SyscallN, r.Bytes)
+	return fmt.Sprintf("syscall: %s (%d), bytes: %s", SyscallToName(r.SyscallN), r.SyscallN, formatPayload(r.Bytes))
 }
 
 type SyscallResponse struct {
@@ -58,7 +154,7 @@ type SyscallResponse struct {
 }
 
 func (r *SyscallResponse) DebugString() string {
-	return fmt.Sprintf("syscall: %s (%d), status: %d, bytes: %v", SyscallToName(r.SyscallN), r.SyscallN, r.Status, r.Bytes)
+	return fmt.Sprintf("syscall: %s (%d), status: %d, bytes: %s", SyscallToName(r.SyscallN), r.SyscallN, r.Status, formatPayload(r.Bytes))
 }
 
 func (r *SyscallResponse) Serialize() []byte {
@@ -119,15 +215,136 @@ func MuxCall(req *SyscallRequest) (*SyscallResponse, error) {
 			return nil, err
 		}
 		return handleSocketCall(call)
+	case SYSCALL_WRITEV:
+		call, err := decodeWritevCall(req.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return handleWritevCall(call)
+	case SYSCALL_PREAD:
+		call, err := decodePreadCall(req.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return handlePreadCall(call)
+	case SYSCALL_FTRUNCATE:
+		call, err := decodeFtruncateCall(req.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return handleFtruncateCall(call)
+	case SYSCALL_MKDIR:
+		call, err := decodeMkdirCall(req.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return handleMkdirCall(call)
+	case SYSCALL_UNLINK:
+		call, err := decodeUnlinkCall(req.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return handleUnlinkCall(call)
+	case SYSCALL_RENAME:
+		call, err := decodeRenameCall(req.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return handleRenameCall(call)
+	case SYSCALL_FDLIST:
+		return handleFdlistCall()
+	case SYSCALL_CAPABILITIES:
+		return handleCapabilitiesCall()
+	case SYSCALL_IOCTL:
+		call, err := decodeIoctlCall(req.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return handleIoctlCall(call)
+	case SYSCALL_GETRANDOM:
+		call, err := decodeGetrandomCall(req.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return handleGetrandomCall(call)
+	case SYSCALL_SET_TID_ADDRESS, SYSCALL_GETPID, SYSCALL_GETPPID, SYSCALL_GETUID,
+		SYSCALL_GETEUID, SYSCALL_GETGID, SYSCALL_GETEGID, SYSCALL_GETTID:
+		if !LibcStubs {
+			return nil, fmt.Errorf("%w (libc stubs disabled)", ErrUnknownSyscall)
+		}
+		return handleLibcStubCall(req.SyscallN)
 	case SYSCALL_FAILED:
 	default:
-		return nil, fmt.Errorf("unknown syscall number")
+		return nil, ErrUnknownSyscall
 	}
 
 	return nil, nil
 }
 
+// Every syscall an ecall view in sql/click-v.sql forwards to MuxCall, plus PRINT and DRAW which the CPU handles itself.
+// RESET is left out: MuxCall answers it, but only for the host, the ecall filter drops syscall 0.
+// Keep in sync with MuxCall and the ecall views.
+var baseSyscalls = []uint32{
+	SYSCALL_PRINT, SYSCALL_DRAW,
+	SYSCALL_OPEN, SYSCALL_CLOSE, SYSCALL_SEEK, SYSCALL_READ, SYSCALL_WRITE, SYSCALL_SOCKET,
+	SYSCALL_WRITEV, SYSCALL_PREAD, SYSCALL_FTRUNCATE, SYSCALL_MKDIR, SYSCALL_UNLINK, SYSCALL_RENAME,
+	SYSCALL_FDLIST, SYSCALL_CAPABILITIES, SYSCALL_IOCTL, SYSCALL_GETRANDOM,
+}
+
+var libcStubSyscalls = []uint32{
+	SYSCALL_SET_TID_ADDRESS, SYSCALL_GETPID, SYSCALL_GETPPID, SYSCALL_GETUID,
+	SYSCALL_GETEUID, SYSCALL_GETGID, SYSCALL_GETEGID, SYSCALL_GETTID,
+}
+
+// SupportedSyscalls lists the syscall numbers the guest can use with the current settings
+func SupportedSyscalls() []uint32 {
+	supported := append([]uint32{}, baseSyscalls...)
+	if LibcStubs {
+		supported = append(supported, libcStubSyscalls...)
+	}
+
+	return supported
+}
+
+// handleCapabilitiesCall returns a bitmask with bit n%8 of byte n/8 set when syscall n is supported,
+// so guest libc can fall back (e.g. from PREAD to SEEK + READ). Status is the mask length in bytes.
+func handleCapabilitiesCall() (*SyscallResponse, error) {
+	supported := SupportedSyscalls()
+
+	var highest uint32
+	for _, syscallN := range supported {
+		highest = max(highest, syscallN)
+	}
+
+	mask := make([]byte, highest/8+1)
+	for _, syscallN := range supported {
+		mask[syscallN/8] |= 1 << (syscallN % 8)
+	}
+
+	return &SyscallResponse{
+		SyscallN: SYSCALL_CAPABILITIES,
+		Status:   int32(len(mask)),
+		Bytes:    mask,
+	}, nil
+}
+
+// RequestFd returns the fd a request's payload starts with, which the server uses to keep each fd's requests in order.
+func RequestFd(req *SyscallRequest) (int32, bool) {
+	switch req.SyscallN {
+	case SYSCALL_CLOSE, SYSCALL_SEEK, SYSCALL_READ, SYSCALL_WRITE, SYSCALL_WRITEV, SYSCALL_PREAD, SYSCALL_FTRUNCATE, SYSCALL_IOCTL:
+		if len(req.Bytes) < 4 {
+			return 0, false
+		}
+		return int32(binary.LittleEndian.Uint32(req.Bytes[0:4])), true
+	default:
+		return 0, false
+	}
+}
+
+// The server handles requests concurrently, so the map and sequence are guarded by fileDescriptorsLock.
+// Each descriptor has its own lock that is held for the whole operation.
 var fileDescriptors = make(map[int32]*fileDescriptor, 0)
+var fileDescriptorsLock sync.Mutex
 
 type descriptorType uint8
 
@@ -137,26 +354,180 @@ const FD_PIPE descriptorType = 1
 var fdSequence int32 = 0
 
 type fileDescriptor struct {
-	id    int32
-	seek  int32
-	dType descriptorType
-	name  string
-	file  *os.File
-	pipe  *udpPipe
+	id     int32
+	seek   int32
+	dType  descriptorType
+	name   string
+	file   *os.File
+	pipe   *udpPipe
+	lock   sync.Mutex
+	closed bool
 }
 
-func getNextFdID() int32 {
+// addFileDescriptor assigns the next fd number and makes the descriptor visible to other calls
+func addFileDescriptor(fd *fileDescriptor) int32 {
+	fileDescriptorsLock.Lock()
+	defer fileDescriptorsLock.Unlock()
+
 	fdSequence++
-	return fdSequence
+	fd.id = fdSequence
+	fileDescriptors[fd.id] = fd
+	return fd.id
 }
 
-func handleResetCall() (*SyscallResponse, error) {
-	for _, fd := range fileDescriptors {
-		fd.file.Close()
+// restoreFileDescriptor registers fd under a fixed id. Later descriptors are numbered after it.
+func restoreFileDescriptor(id int32, fd *fileDescriptor) error {
+	fileDescriptorsLock.Lock()
+	defer fileDescriptorsLock.Unlock()
+
+	if id <= 0 {
+		return fmt.Errorf("%w %d", ErrBadFd, id)
+	}
+	if _, ok := fileDescriptors[id]; ok {
+		return fmt.Errorf("%w: %d is already open", ErrBadFd, id)
+	}
+
+	fd.id = id
+	fileDescriptors[id] = fd
+	fdSequence = max(fdSequence, id)
+	return nil
+}
+
+// DescriptorOpen reports whether id is currently an open descriptor
+func DescriptorOpen(id int32) bool {
+	fileDescriptorsLock.Lock()
+	defer fileDescriptorsLock.Unlock()
+
+	_, ok := fileDescriptors[id]
+	return ok
+}
+
+// lockFileDescriptor returns the descriptor with its lock held. The caller must unlock it.
+func lockFileDescriptor(id int32) (*fileDescriptor, error) {
+	fileDescriptorsLock.Lock()
+	fd, ok := fileDescriptors[id]
+	fileDescriptorsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %d not found", ErrBadFd, id)
+	}
+
+	fd.lock.Lock()
+	if fd.closed {
+		// closed by another request while we waited
+		fd.lock.Unlock()
+		return nil, fmt.Errorf("%w: %d not found", ErrBadFd, id)
 	}
 
+	return fd, nil
+}
+
+// Close must be called with fd.lock held
+func (fd *fileDescriptor) Close() error {
+	if fd.closed {
+		return nil
+	}
+	fd.closed = true
+
+	if fd.dType == FD_FILE {
+		err := fd.file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close file: %w: %w", ErrIO, err)
+		}
+	} else if fd.dType == FD_PIPE {
+		err := fd.pipe.Close()
+		if err != nil {
+			return fmt.Errorf("failed to close UDP pipe: %w: %w", ErrIO, err)
+		}
+	}
+
+	return nil
+}
+
+// CloseAllDescriptors closes every open file and socket and starts fd numbering over.
+// Used by RESET and on server shutdown.
+func CloseAllDescriptors() {
+	fileDescriptorsLock.Lock()
+	open := fileDescriptors
 	fileDescriptors = make(map[int32]*fileDescriptor, 0)
 	fdSequence = 0
+	fileDescriptorsLock.Unlock()
+
+	for id, fd := range open {
+		fd.lock.Lock()
+		err := fd.Close()
+		fd.lock.Unlock()
+		if err != nil {
+			logger.Warnf("fd %d (%s): %v", id, fd.name, err)
+		}
+	}
+}
+
+type DescriptorInfo struct {
+	ID   int32
+	Type uint8 // FD_FILE or FD_PIPE
+	Name string
+	Seek int32
+}
+
+// ListDescriptors returns the open descriptors ordered by id
+func ListDescriptors() []DescriptorInfo {
+	fileDescriptorsLock.Lock()
+	open := make([]*fileDescriptor, 0, len(fileDescriptors))
+	for _, fd := range fileDescriptors {
+		open = append(open, fd)
+	}
+	fileDescriptorsLock.Unlock()
+
+	infos := make([]DescriptorInfo, 0, len(open))
+	for _, fd := range open {
+		fd.lock.Lock()
+		if !fd.closed {
+			infos = append(infos, DescriptorInfo{fd.id, uint8(fd.dType), fd.name, fd.seek})
+		}
+		fd.lock.Unlock()
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos
+}
+
+// handleFdlistCall serializes each open descriptor as id (4), type (1), seek (4), name length (4), name.
+// Status is the number of descriptors.
+func handleFdlistCall() (*SyscallResponse, error) {
+	infos := ListDescriptors()
+
+	var out []byte
+	for _, info := range infos {
+		out = binary.LittleEndian.AppendUint32(out, uint32(info.ID))
+		out = append(out, info.Type)
+		out = binary.LittleEndian.AppendUint32(out, uint32(info.Seek))
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(info.Name)))
+		out = append(out, info.Name...)
+	}
+
+	return &SyscallResponse{
+		SyscallN: SYSCALL_FDLIST,
+		Status:   int32(len(infos)),
+		Bytes:    out,
+	}, nil
+}
+
+// ResetHook runs after RESET closes every descriptor, e.g. to clear the CPU state in ClickHouse. Nil by default.
+// RESET only comes from the host (SELECT clickos_syscall(0, [])), the ecall filter never forwards syscall 0.
+var ResetHook func() error
+
+func handleResetCall() (*SyscallResponse, error) {
+	CloseAllDescriptors()
+
+	if ResetHook != nil {
+		err := ResetHook()
+		if err != nil {
+			return nil, fmt.Errorf("reset hook failed: %w: %w", ErrIO, err)
+		}
+	}
 
 	return &SyscallResponse{
 		SyscallN: SYSCALL_RESET,
@@ -168,12 +539,18 @@ type openCall struct {
 	flags    int32
 }
 
+// Longest path or address accepted from the guest, including the terminator
+const MAX_PATH_LEN = 4096
+
 func decodeOpenCall(bytes []byte) (openCall, error) {
 	offset := 0
-	pathName := ReadCString(bytes)
+	pathName, terminated := ReadCStringN(bytes, MAX_PATH_LEN)
+	if !terminated {
+		return openCall{}, fmt.Errorf("invalid open call: %w: path is not NUL terminated", ErrBadPayload)
+	}
 	offset += len(pathName) + 1
 	if len(bytes) < offset+4 {
-		return openCall{}, fmt.Errorf("invalid open call: payload too short")
+		return openCall{}, fmt.Errorf("invalid open call: %w", ErrShortPayload)
 	}
 
 	flags := int32(binary.LittleEndian.Uint32(bytes[offset : offset+4]))
@@ -182,25 +559,43 @@ func decodeOpenCall(bytes []byte) (openCall, error) {
 	return openCall{pathName, flags}, nil
 }
 
+// Linux RISC-V O_CREAT, the only open flag ClickOS looks at
+const OPEN_O_CREAT int32 = 0x40
+
+// CreateOnOpen creates missing files even without O_CREAT, like ClickOS used to.
+// Off by default so a mistyped path fails with ENOENT instead of reading an empty file.
+var CreateOnOpen = false
+
 func handleOpenCall(call openCall) (*SyscallResponse, error) {
 	fd := fileDescriptor{
-		id:    getNextFdID(),
 		seek:  0,
 		dType: FD_FILE,
 		name:  call.pathName,
 	}
 
-	file, err := os.OpenFile(call.pathName, os.O_CREATE|os.O_RDWR, 0666)
+	flags := os.O_RDWR
+	if CreateOnOpen || call.flags&OPEN_O_CREAT != 0 {
+		flags |= os.O_CREATE
+	}
+
+	file, err := os.OpenFile(call.pathName, flags, 0666)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %w", err)
+		errno, ok := toErrno(err)
+		if !ok {
+			return nil, fmt.Errorf("failed to open file: %w: %w", ErrIO, err)
+		}
+
+		return &SyscallResponse{
+			SyscallN: SYSCALL_OPEN,
+			Status:   errno,
+		}, nil
 	}
 
 	fd.file = file
 
-	fileDescriptors[fd.id] = &fd
 	return &SyscallResponse{
 		SyscallN: SYSCALL_OPEN,
-		Status:   fd.id,
+		Status:   addFileDescriptor(&fd),
 	}, nil
 }
 
@@ -210,7 +605,7 @@ type closeCall struct {
 
 func decodeCloseCall(bytes []byte) (closeCall, error) {
 	if len(bytes) < 4 {
-		return closeCall{}, fmt.Errorf("invalid close call: payload too short")
+		return closeCall{}, fmt.Errorf("invalid close call: %w", ErrShortPayload)
 	}
 
 	offset := 0
@@ -221,30 +616,30 @@ func decodeCloseCall(bytes []byte) (closeCall, error) {
 }
 
 func handleCloseCall(call closeCall) (*SyscallResponse, error) {
-	fd, ok := fileDescriptors[call.fd]
-	if !ok {
-		return nil, fmt.Errorf("file descriptor %d not found", call.fd)
+	fd, err := lockFileDescriptor(call.fd)
+	if err != nil {
+		return nil, err
 	}
+	defer fd.lock.Unlock()
 
-	if fd.dType == FD_FILE {
-		err := fd.file.Close()
-		if err != nil {
-			return nil, fmt.Errorf("failed to close file: %w", err)
-		}
-	} else if fd.dType == FD_PIPE {
-		err := fd.pipe.Close()
-		if err != nil {
-			return nil, fmt.Errorf("failed to close UDP pipe: %w", err)
-		}
+	err = fd.Close()
+	if err != nil {
+		return nil, err
 	}
 
+	fileDescriptorsLock.Lock()
 	delete(fileDescriptors, call.fd)
+	fileDescriptorsLock.Unlock()
 	return &SyscallResponse{
 		SyscallN: SYSCALL_CLOSE,
 		Status:   0,
 	}, nil
 }
 
+const SEEK_SET int32 = 0
+const SEEK_CUR int32 = 1
+const SEEK_END int32 = 2
+
 type seekCall struct {
 	fd     int32
 	offset int32
@@ -253,7 +648,7 @@ type seekCall struct {
 
 func decodeSeekCall(bytes []byte) (seekCall, error) {
 	if len(bytes) < (4 + 4 + 4) {
-		return seekCall{}, fmt.Errorf("invalid seek call: payload too short")
+		return seekCall{}, fmt.Errorf("invalid seek call: %w", ErrShortPayload)
 	}
 
 	offset := 0
@@ -272,16 +667,26 @@ func decodeSeekCall(bytes []byte) (seekCall, error) {
 }
 
 func handleSeekCall(call seekCall) (*SyscallResponse, error) {
-	fd, ok := fileDescriptors[call.fd]
-	if !ok {
-		return nil, fmt.Errorf("file descriptor %d not found", call.fd)
-	} else if fd.dType != FD_FILE {
-		return nil, fmt.Errorf("cannot seek: file descriptor %d is not a file", call.fd)
+	fd, err := lockFileDescriptor(call.fd)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.lock.Unlock()
+
+	if fd.dType != FD_FILE {
+		return nil, fmt.Errorf("cannot seek: %w: %d is not a file", ErrBadFd, call.fd)
+	}
+
+	if call.whence != SEEK_SET && call.whence != SEEK_CUR && call.whence != SEEK_END {
+		return &SyscallResponse{
+			SyscallN: SYSCALL_SEEK,
+			Status:   ERRNO_EINVAL,
+		}, nil
 	}
 
 	current, err := fd.file.Seek(int64(call.offset), int(call.whence))
 	if err != nil {
-		return nil, fmt.Errorf("failed to seek file: %w", err)
+		return nil, fmt.Errorf("failed to seek file: %w: %w", ErrIO, err)
 	}
 
 	fd.seek = int32(current)
@@ -291,6 +696,12 @@ func handleSeekCall(call seekCall) (*SyscallResponse, error) {
 	}, nil
 }
 
+// MaxReadCount caps the buffer READ and PREAD allocate, since count comes straight from the guest.
+// Larger requests return a short read and the guest loops for the rest, as with any short read.
+// It also bounds the response: bytes are serialized as decimal text, so 16 KiB is about 9 datagrams,
+// and a larger response sent as one burst of chunks is likely to lose one.
+var MaxReadCount uint32 = 16 << 10
+
 type readCall struct {
 	fd    int32
 	count uint32
@@ -298,7 +709,7 @@ type readCall struct {
 
 func decodeReadCall(bytes []byte) (readCall, error) {
 	if len(bytes) < (4 + 4) {
-		return readCall{}, fmt.Errorf("invalid read call: payload too short")
+		return readCall{}, fmt.Errorf("invalid read call: %w", ErrShortPayload)
 	}
 
 	offset := 0
@@ -311,25 +722,33 @@ func decodeReadCall(bytes []byte) (readCall, error) {
 }
 
 func handleReadCall(call readCall) (*SyscallResponse, error) {
-	fd, ok := fileDescriptors[call.fd]
-	if !ok {
-		return nil, fmt.Errorf("file descriptor %d not found", call.fd)
+	fd, err := lockFileDescriptor(call.fd)
+	if err != nil {
+		return nil, err
 	}
+	defer fd.lock.Unlock()
 
-	buf := make([]byte, call.count)
+	buf := make([]byte, min(call.count, MaxReadCount))
 	var n int = 0
-	var err error
 	if fd.dType == FD_FILE {
 		n, err = fd.file.Read(buf)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read file: %w", err)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to read file: %w: %w", ErrIO, err)
 		}
 
 		fd.seek += int32(n)
 	} else if fd.dType == FD_PIPE {
 		n, err = fd.pipe.Read(buf)
 		if err != nil {
-			return nil, fmt.Errorf("failed to write UDP: %w", err)
+			return nil, fmt.Errorf("failed to write UDP: %w: %w", ErrIO, err)
+		}
+
+		if n < 0 {
+			// Nothing buffered, status carries PIPE_EAGAIN
+			return &SyscallResponse{
+				SyscallN: SYSCALL_READ,
+				Status:   int32(n),
+			}, nil
 		}
 	}
 
@@ -340,6 +759,99 @@ func handleReadCall(call readCall) (*SyscallResponse, error) {
 	}, nil
 }
 
+type preadCall struct {
+	fd     int32
+	offset uint32
+	count  uint32
+}
+
+func decodePreadCall(bytes []byte) (preadCall, error) {
+	if len(bytes) < (4 + 4 + 4) {
+		return preadCall{}, fmt.Errorf("invalid pread call: %w", ErrShortPayload)
+	}
+
+	offset := 0
+	fd := int32(binary.LittleEndian.Uint32(bytes[offset : offset+4]))
+	offset += 4
+	readOffset := binary.LittleEndian.Uint32(bytes[offset : offset+4])
+	offset += 4
+	count := binary.LittleEndian.Uint32(bytes[offset : offset+4])
+	offset += 4
+
+	return preadCall{fd, readOffset, count}, nil
+}
+
+// handlePreadCall reads at a fixed offset without moving the file position, for random access into e.g. a WAD
+func handlePreadCall(call preadCall) (*SyscallResponse, error) {
+	fd, err := lockFileDescriptor(call.fd)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.lock.Unlock()
+
+	if fd.dType != FD_FILE {
+		return nil, fmt.Errorf("cannot pread: %w: %d is not a file", ErrBadFd, call.fd)
+	}
+
+	buf := make([]byte, min(call.count, MaxReadCount))
+	n, err := fd.file.ReadAt(buf, int64(call.offset))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read file: %w: %w", ErrIO, err)
+	}
+
+	return &SyscallResponse{
+		SyscallN: SYSCALL_PREAD,
+		Status:   int32(n),
+		Bytes:    buf[:n],
+	}, nil
+}
+
+type ftruncateCall struct {
+	fd     int32
+	length int32
+}
+
+func decodeFtruncateCall(bytes []byte) (ftruncateCall, error) {
+	if len(bytes) < (4 + 4) {
+		return ftruncateCall{}, fmt.Errorf("invalid ftruncate call: %w", ErrShortPayload)
+	}
+
+	offset := 0
+	fd := int32(binary.LittleEndian.Uint32(bytes[offset : offset+4]))
+	offset += 4
+	length := int32(binary.LittleEndian.Uint32(bytes[offset : offset+4]))
+	offset += 4
+
+	return ftruncateCall{fd, length}, nil
+}
+
+// handleFtruncateCall shrinks (or zero-extends) a file, e.g. when a smaller savegame is written over a larger one.
+// Like Linux, the file position is not changed.
+func handleFtruncateCall(call ftruncateCall) (*SyscallResponse, error) {
+	fd, err := lockFileDescriptor(call.fd)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.lock.Unlock()
+
+	if fd.dType != FD_FILE || call.length < 0 {
+		return &SyscallResponse{
+			SyscallN: SYSCALL_FTRUNCATE,
+			Status:   ERRNO_EINVAL,
+		}, nil
+	}
+
+	err = fd.file.Truncate(int64(call.length))
+	if err != nil {
+		return nil, fmt.Errorf("failed to truncate file: %w: %w", ErrIO, err)
+	}
+
+	return &SyscallResponse{
+		SyscallN: SYSCALL_FTRUNCATE,
+		Status:   0,
+	}, nil
+}
+
 type writeCall struct {
 	fd    int32
 	bytes []byte
@@ -347,7 +859,7 @@ type writeCall struct {
 
 func decodeWriteCall(bytes []byte) (writeCall, error) {
 	if len(bytes) < 4 {
-		return writeCall{}, fmt.Errorf("invalid write call: payload too short")
+		return writeCall{}, fmt.Errorf("invalid write call: %w", ErrShortPayload)
 	}
 
 	offset := 0
@@ -362,31 +874,109 @@ func decodeWriteCall(bytes []byte) (writeCall, error) {
 }
 
 func handleWriteCall(call writeCall) (*SyscallResponse, error) {
-	fd, ok := fileDescriptors[call.fd]
-	if !ok {
-		log.Printf("fileDescriptors: %#v\n", fileDescriptors)
-		return nil, fmt.Errorf("file descriptor %d not found", call.fd)
+	fd, err := lockFileDescriptor(call.fd)
+	if err != nil {
+		return nil, err
 	}
+	defer fd.lock.Unlock()
 
+	n, err := writeDescriptor(fd, call.bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyscallResponse{
+		SyscallN: SYSCALL_WRITE,
+		Status:   int32(n),
+	}, nil
+}
+
+func writeDescriptor(fd *fileDescriptor, bytes []byte) (int, error) {
 	var n int = 0
 	var err error
 	if fd.dType == FD_FILE {
-		n, err = fd.file.Write(call.bytes)
+		n, err = fd.file.Write(bytes)
 		if err != nil {
-			return nil, fmt.Errorf("failed to write file: %w", err)
+			return n, fmt.Errorf("failed to write file: %w: %w", ErrIO, err)
 		}
 
 		fd.seek += int32(n)
 	} else if fd.dType == FD_PIPE {
-		n, err = fd.pipe.Write(call.bytes)
+		n, err = fd.pipe.Write(bytes)
 		if err != nil {
-			return nil, fmt.Errorf("failed to write UDP: %w", err)
+			return n, fmt.Errorf("failed to write UDP: %w: %w", ErrIO, err)
+		}
+	}
+
+	return n, nil
+}
+
+// Same limit as Linux IOV_MAX
+const MAX_WRITEV_SEGMENTS = 1024
+
+type writevCall struct {
+	fd       int32
+	segments [][]byte
+}
+
+// decodeWritevCall decodes fd, segment count, then count * (length, bytes).
+// The payload comes straight off the network, so every length is checked against what's left.
+func decodeWritevCall(bytes []byte) (writevCall, error) {
+	if len(bytes) < (4 + 4) {
+		return writevCall{}, fmt.Errorf("invalid writev call: %w", ErrShortPayload)
+	}
+
+	offset := 0
+	fd := int32(binary.LittleEndian.Uint32(bytes[offset : offset+4]))
+	offset += 4
+	count := binary.LittleEndian.Uint32(bytes[offset : offset+4])
+	offset += 4
+
+	if count > MAX_WRITEV_SEGMENTS {
+		return writevCall{}, fmt.Errorf("invalid writev call: %w: %d segments exceeds max of %d", ErrBadPayload, count, MAX_WRITEV_SEGMENTS)
+	}
+
+	segments := make([][]byte, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(bytes)-offset < 4 {
+			return writevCall{}, fmt.Errorf("invalid writev call: %w: segment %d length missing", ErrShortPayload, i)
+		}
+		segmentLen := binary.LittleEndian.Uint32(bytes[offset : offset+4])
+		offset += 4
+
+		if uint64(segmentLen) > uint64(len(bytes)-offset) {
+			return writevCall{}, fmt.Errorf("invalid writev call: %w: segment %d length %d exceeds payload", ErrShortPayload, i, segmentLen)
+		}
+		segments = append(segments, bytes[offset:offset+int(segmentLen)])
+		offset += int(segmentLen)
+	}
+
+	if offset != len(bytes) {
+		return writevCall{}, fmt.Errorf("invalid writev call: %w: %d trailing bytes", ErrBadPayload, len(bytes)-offset)
+	}
+
+	return writevCall{fd, segments}, nil
+}
+
+func handleWritevCall(call writevCall) (*SyscallResponse, error) {
+	fd, err := lockFileDescriptor(call.fd)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.lock.Unlock()
+
+	total := 0
+	for _, segment := range call.segments {
+		n, err := writeDescriptor(fd, segment)
+		total += n
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	return &SyscallResponse{
-		SyscallN: SYSCALL_WRITE,
-		Status:   int32(n),
+		SyscallN: SYSCALL_WRITEV,
+		Status:   int32(total),
 	}, nil
 }
 
@@ -396,26 +986,62 @@ type socketCall struct {
 
 func decodeSocketCall(bytes []byte) (socketCall, error) {
 	offset := 0
-	address := ReadCString(bytes)
+	address, terminated := ReadCStringN(bytes, MAX_PATH_LEN)
+	if !terminated {
+		return socketCall{}, fmt.Errorf("invalid socket call: %w: address is not NUL terminated", ErrBadPayload)
+	}
 	offset += len(address) + 1
 
 	return socketCall{address}, nil
 }
 
 type udpPipe struct {
-	fd      *fileDescriptor
 	conn    *net.UDPConn
 	packets chan []byte
+	policy  PipeFullPolicy
+	dropped atomic.Uint64
 	done    chan struct{}
 	err     error
 }
 
 const PIPE_EAGAIN int32 = -64
 
-func newUDPPipe(fd *fileDescriptor, conn *net.UDPConn) *udpPipe {
+// PipeFullPolicy decides what backgroundRead does with a datagram when the guest hasn't read the buffer down
+type PipeFullPolicy uint8
+
+const PIPE_FULL_DROP_NEWEST PipeFullPolicy = 0 // discard the incoming datagram, like a full kernel socket buffer
+const PIPE_FULL_DROP_OLDEST PipeFullPolicy = 1 // discard the oldest buffered datagram to make room
+const PIPE_FULL_BLOCK PipeFullPolicy = 2       // stop reading the socket until the guest catches up
+
+func ParsePipeFullPolicy(name string) (PipeFullPolicy, error) {
+	switch name {
+	case "drop-newest":
+		return PIPE_FULL_DROP_NEWEST, nil
+	case "drop-oldest":
+		return PIPE_FULL_DROP_OLDEST, nil
+	case "block":
+		return PIPE_FULL_BLOCK, nil
+	default:
+		return 0, fmt.Errorf("unknown pipe full policy %q (expected drop-newest, drop-oldest, or block)", name)
+	}
+}
+
+// Applied to sockets opened after they are set
+var PipeBufferSize = 32
+var PipeFull = PIPE_FULL_DROP_NEWEST
+
+// Datagrams dropped by all pipes since the server started
+var droppedPackets atomic.Uint64
+
+func DroppedPackets() uint64 {
+	return droppedPackets.Load()
+}
+
+func newUDPPipe(conn *net.UDPConn) *udpPipe {
 	return &udpPipe{
 		conn:    conn,
-		packets: make(chan []byte, 32),
+		packets: make(chan []byte, max(PipeBufferSize, 1)),
+		policy:  PipeFull,
 		done:    make(chan struct{}),
 	}
 }
@@ -426,24 +1052,61 @@ func (p *udpPipe) backgroundRead() {
 		case <-p.done:
 			return
 		default:
-			packet := make([]byte, 8192)
+			packet := make([]byte, MaxDatagramSize)
 			n, _, err := p.conn.ReadFromUDP(packet)
 			if err != nil {
-				log.Printf("failed to read UDP: %v\n", err)
+				logger.Warnf("failed to read UDP: %v", err)
 				p.err = err
 				break
 			}
 
-			p.packets <- packet[:n]
+			p.push(packet[:n])
 		}
 	}
 }
 
+func (p *udpPipe) push(packet []byte) {
+	switch p.policy {
+	case PIPE_FULL_BLOCK:
+		select {
+		case p.packets <- packet:
+		case <-p.done:
+		}
+		return
+	case PIPE_FULL_DROP_OLDEST:
+		for {
+			select {
+			case p.packets <- packet:
+				return
+			default:
+			}
+
+			// The guest may drain the buffer between the two selects, so only count a drop if one was taken
+			select {
+			case <-p.packets:
+				p.drop()
+			default:
+			}
+		}
+	default:
+		select {
+		case p.packets <- packet:
+		default:
+			p.drop()
+		}
+	}
+}
+
+func (p *udpPipe) drop() {
+	p.dropped.Add(1)
+	droppedPackets.Add(1)
+	logger.Debugf("UDP pipe %s buffer full, dropped packet", p.conn.RemoteAddr())
+}
+
 func (p *udpPipe) Read(b []byte) (int, error) {
 	select {
 	case packet := <-p.packets:
-		copy(b, packet)
-		return len(packet), nil
+		return copy(b, packet), nil
 	case <-p.done:
 		return -1, p.err
 	default:
@@ -459,36 +1122,191 @@ func (p *udpPipe) Write(b []byte) (int, error) {
 	return n, nil
 }
 
+// packets is left open: backgroundRead may still be pushing, and Read watches done instead
 func (p *udpPipe) Close() error {
 	close(p.done)
-	close(p.packets)
+	if dropped := p.dropped.Load(); dropped > 0 {
+		logger.Warnf("UDP pipe %s dropped %d packets with a full buffer", p.conn.RemoteAddr(), dropped)
+	}
+
 	return p.conn.Close()
 }
 
-func handleSocketCall(call socketCall) (*SyscallResponse, error) {
-	fd := fileDescriptor{
-		id:    getNextFdID(),
+// dialSocket connects a UDP pipe to address. The descriptor's name is the address, so FDLIST reports what to pass to BootstrapSocket.
+func dialSocket(address string) (*fileDescriptor, error) {
+	fd := &fileDescriptor{
 		seek:  0,
 		dType: FD_PIPE,
-		name:  call.address,
+		name:  address,
 	}
 
-	resolvedAddr, err := net.ResolveUDPAddr("udp", call.address)
+	resolvedAddr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
-		return nil, fmt.Errorf("failed to socket file: %w", err)
+		return nil, fmt.Errorf("failed to resolve socket address: %w: %w", ErrBadPayload, err)
 	}
 
 	conn, err := net.DialUDP("udp", nil, resolvedAddr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial UDP: %w", err)
+		return nil, fmt.Errorf("failed to dial UDP: %w: %w", ErrIO, err)
 	}
 
-	fd.pipe = newUDPPipe(&fd, conn)
+	fd.pipe = newUDPPipe(conn)
 	go fd.pipe.backgroundRead()
 
-	fileDescriptors[fd.id] = &fd
+	return fd, nil
+}
+
+func handleSocketCall(call socketCall) (*SyscallResponse, error) {
+	fd, err := dialSocket(call.address)
+	if err != nil {
+		return nil, err
+	}
+
 	return &SyscallResponse{
 		SyscallN: SYSCALL_SOCKET,
-		Status:   fd.id,
+		Status:   addFileDescriptor(fd),
+	}, nil
+}
+
+// BootstrapSocket re-opens a UDP socket at a known fd, for resuming a guest that had one open.
+// Only the connection is restored: datagrams that were buffered but unread when the snapshot was
+// taken are lost, and the socket gets a new local port, so peers see a new sender.
+func BootstrapSocket(id int32, address string) error {
+	fd, err := dialSocket(address)
+	if err != nil {
+		return err
+	}
+
+	err = restoreFileDescriptor(id, fd)
+	if err != nil {
+		fd.pipe.Close()
+		return err
+	}
+
+	return nil
+}
+
+// The guest is the only process: pid/tid 1, parent 0, running as root.
+func handleLibcStubCall(syscallN uint32) (*SyscallResponse, error) {
+	var status int32
+	switch syscallN {
+	case SYSCALL_SET_TID_ADDRESS, SYSCALL_GETPID, SYSCALL_GETTID:
+		status = 1
+	case SYSCALL_GETPPID, SYSCALL_GETUID, SYSCALL_GETEUID, SYSCALL_GETGID, SYSCALL_GETEGID:
+		status = 0
+	}
+
+	return &SyscallResponse{
+		SyscallN: syscallN,
+		Status:   status,
+	}, nil
+}
+
+// ioctl request codes (Linux asm-generic)
+const TCGETS uint32 = 0x5401     // libc isatty(), no payload returned
+const TIOCGWINSZ uint32 = 0x5413 // struct winsize { rows, cols, xpixel, ypixel uint16 }
+
+// Fixed terminal size reported for the standard descriptors
+const TERMINAL_ROWS uint16 = 24
+const TERMINAL_COLS uint16 = 80
+
+type ioctlCall struct {
+	fd      int32
+	request uint32
+}
+
+func decodeIoctlCall(bytes []byte) (ioctlCall, error) {
+	if len(bytes) < (4 + 4) {
+		return ioctlCall{}, fmt.Errorf("invalid ioctl call: %w", ErrShortPayload)
+	}
+
+	offset := 0
+	fd := int32(binary.LittleEndian.Uint32(bytes[offset : offset+4]))
+	offset += 4
+	request := binary.LittleEndian.Uint32(bytes[offset : offset+4])
+	offset += 4
+
+	return ioctlCall{fd, request}, nil
+}
+
+// handleIoctlCall treats fds 0-2 as a terminal so guest libc picks line buffering for stdout.
+// Everything else is not a tty.
+func handleIoctlCall(call ioctlCall) (*SyscallResponse, error) {
+	if call.fd < 0 || call.fd > 2 {
+		return &SyscallResponse{
+			SyscallN: SYSCALL_IOCTL,
+			Status:   ERRNO_ENOTTY,
+		}, nil
+	}
+
+	switch call.request {
+	case TCGETS:
+		return &SyscallResponse{
+			SyscallN: SYSCALL_IOCTL,
+			Status:   0,
+		}, nil
+	case TIOCGWINSZ:
+		winsize := make([]byte, 8)
+		binary.LittleEndian.PutUint16(winsize[0:], TERMINAL_ROWS)
+		binary.LittleEndian.PutUint16(winsize[2:], TERMINAL_COLS)
+		return &SyscallResponse{
+			SyscallN: SYSCALL_IOCTL,
+			Status:   0,
+			Bytes:    winsize,
+		}, nil
+	default:
+		return &SyscallResponse{
+			SyscallN: SYSCALL_IOCTL,
+			Status:   ERRNO_EINVAL,
+		}, nil
+	}
+}
+
+// Linux guarantees getrandom requests up to 256 bytes are filled in full.
+// Larger requests are clamped and the guest loops like it would for a short read.
+const MAX_GETRANDOM_LEN uint32 = 256
+
+// A seeded *rand.Rand isn't safe for concurrent use, and each call must take a whole
+// chunk of the sequence for seeded runs to be reproducible, so reads hold randomSourceLock.
+var randomSource io.Reader = cryptorand.Reader
+var randomSourceLock sync.Mutex
+
+// SeedRandom switches GETRANDOM to a deterministic source so runs can be reproduced.
+func SeedRandom(seed int64) {
+	randomSourceLock.Lock()
+	defer randomSourceLock.Unlock()
+
+	randomSource = rand.New(rand.NewSource(seed))
+}
+
+type getrandomCall struct {
+	count uint32
+}
+
+func decodeGetrandomCall(bytes []byte) (getrandomCall, error) {
+	if len(bytes) < 4 {
+		return getrandomCall{}, fmt.Errorf("invalid getrandom call: %w", ErrShortPayload)
+	}
+
+	offset := 0
+	count := binary.LittleEndian.Uint32(bytes[offset : offset+4])
+	offset += 4
+
+	return getrandomCall{count}, nil
+}
+
+func handleGetrandomCall(call getrandomCall) (*SyscallResponse, error) {
+	buffer := make([]byte, min(call.count, MAX_GETRANDOM_LEN))
+	randomSourceLock.Lock()
+	_, err := io.ReadFull(randomSource, buffer)
+	randomSourceLock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w: %w", ErrIO, err)
+	}
+
+	return &SyscallResponse{
+		SyscallN: SYSCALL_GETRANDOM,
+		Status:   int32(len(buffer)),
+		Bytes:    buffer,
 	}, nil
 }
@@ -10,6 +10,8 @@ import (
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 )
 
+const pingTimeout = 30 * time.Second
+
 func GetClickHouseConnection() (driver.Conn, error) {
 	conn, err := clickhouse.Open(&clickhouse.Options{
 		Addr: []string{"0.0.0.0:9000"},
@@ -44,7 +46,11 @@ func GetClickHouseConnection() (driver.Conn, error) {
 		return nil, err
 	}
 
-	err = conn.Ping(context.Background())
+	// Bound the ping too, a server that accepts the connection but never answers shouldn't hang callers
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+
+	err = conn.Ping(ctx)
 	if err != nil {
 		return nil, err
 	}
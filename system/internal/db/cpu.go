@@ -0,0 +1,19 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// ReadClickHousePC returns the CPU's program counter from clickv.pc
+func ReadClickHousePC(ctx context.Context, conn driver.Conn) (uint32, error) {
+	var pc uint32
+	err := conn.QueryRow(ctx, "SELECT value FROM clickv.pc").Scan(&pc)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get PC: %w", err)
+	}
+
+	return pc, nil
+}
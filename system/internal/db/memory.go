@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// ReadClickHouseMemorySize returns the number of addressable bytes in clickv.memory (highest address + 1).
+func ReadClickHouseMemorySize(ctx context.Context, conn driver.Conn) (uint32, error) {
+	var size uint64
+	err := conn.QueryRow(ctx, "SELECT if(count() = 0, 0, max(address) + 1) FROM clickv.memory").Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get memory size: %w", err)
+	}
+
+	return uint32(size), nil
+}
+
+// ReadClickHouseMemoryRange reads length bytes starting at start. Addresses missing from the table read as 0.
+func ReadClickHouseMemoryRange(ctx context.Context, conn driver.Conn, start uint32, length uint32) ([]byte, error) {
+	rows, err := conn.Query(ctx, "SELECT address, value FROM clickv.memory WHERE address >= ? AND address < ?", start, uint64(start)+uint64(length))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read memory range: %w", err)
+	}
+	defer rows.Close()
+
+	memory := make([]byte, length)
+	for rows.Next() {
+		var address uint32
+		var value uint8
+		err := rows.Scan(&address, &value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan memory row: %w", err)
+		}
+
+		memory[address-start] = value
+	}
+
+	return memory, rows.Err()
+}
+
+// MemoryDiff is a run of consecutive addresses that differ between two memory images.
+// Old or New is shorter than the range when one image ends inside it.
+type MemoryDiff struct {
+	Start uint32
+	Old   []byte
+	New   []byte
+}
+
+func (d MemoryDiff) Len() int {
+	return max(len(d.Old), len(d.New))
+}
+
+// DiffMemory compares two images that start at the same address and returns the differing ranges, lowest first.
+// Identical regions produce nothing, however large, and bytes past the end of the shorter image always differ.
+func DiffMemory(a []byte, b []byte) []MemoryDiff {
+	var diffs []MemoryDiff
+	length := max(len(a), len(b))
+	for i := 0; i < length; {
+		if i < len(a) && i < len(b) && a[i] == b[i] {
+			i++
+			continue
+		}
+
+		start := i
+		for i < length && !(i < len(a) && i < len(b) && a[i] == b[i]) {
+			i++
+		}
+		diffs = append(diffs, MemoryDiff{
+			Start: uint32(start),
+			Old:   a[min(start, len(a)):min(i, len(a))],
+			New:   b[min(start, len(b)):min(i, len(b))],
+		})
+	}
+
+	return diffs
+}
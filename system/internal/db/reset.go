@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// ResetClickHouseState puts the CPU back to power-on: PC 0, zeroed registers, memorySize zeroed bytes, and an empty console.
+// The size comes from the caller rather than clickv.memory, since the reset truncates that table:
+// a reset cut short after the truncate would otherwise make every later reset zero no memory at all.
+// The steps aren't atomic, so a failed reset can leave partial state. Running it again fixes that.
+// Only call it while the clock is stopped: a clock cycle in flight writes its PC increment and
+// register results after the reset, leaving the machine in neither state.
+func ResetClickHouseState(ctx context.Context, conn driver.Conn, memorySize uint32) error {
+	err := conn.Exec(ctx, "INSERT INTO clickv.pc (value) VALUES (0)")
+	if err != nil {
+		return fmt.Errorf("failed to reset PC: %w", err)
+	}
+
+	err = conn.Exec(ctx, "TRUNCATE TABLE clickv.registers SYNC")
+	if err != nil {
+		return fmt.Errorf("failed to clear registers: %w", err)
+	}
+	err = conn.Exec(ctx, "INSERT INTO clickv.registers (address, value) SELECT number AS address, 0 AS value FROM numbers(1 + 31)")
+	if err != nil {
+		return fmt.Errorf("failed to zero registers: %w", err)
+	}
+
+	err = conn.Exec(ctx, "TRUNCATE TABLE clickv.memory SYNC")
+	if err != nil {
+		return fmt.Errorf("failed to clear memory: %w", err)
+	}
+	err = conn.Exec(ctx, "INSERT INTO clickv.memory (address, value) SELECT number AS address, 0 AS value FROM numbers(?)", memorySize)
+	if err != nil {
+		return fmt.Errorf("failed to zero memory: %w", err)
+	}
+
+	err = conn.Exec(ctx, "TRUNCATE TABLE clickv.print")
+	if err != nil {
+		return fmt.Errorf("failed to clear console: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package logger
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// Level controls which messages are written. Messages below the current level are dropped.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// LevelEnv is read once at startup, e.g. CLICKOS_LOG_LEVEL=debug
+const LevelEnv = "CLICKOS_LOG_LEVEL"
+
+var currentLevel = ParseLevel(os.Getenv(LevelEnv))
+
+// ParseLevel converts a level name to a Level. Unknown or empty names are INFO.
+func ParseLevel(name string) Level {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug
+	case "warn", "warning":
+		return LevelWarn
+	case "error":
+		return LevelError
+	default:
+		return LevelInfo
+	}
+}
+
+func SetLevel(level Level) {
+	currentLevel = level
+}
+
+func Enabled(level Level) bool {
+	return level >= currentLevel
+}
+
+// Output goes through the standard log package, so log.SetOutput/SetPrefix still apply.
+func logf(level Level, tag string, format string, v ...any) {
+	if !Enabled(level) {
+		return
+	}
+
+	log.Printf(tag+" "+format, v...)
+}
+
+func Debugf(format string, v ...any) {
+	logf(LevelDebug, "DEBUG", format, v...)
+}
+
+func Infof(format string, v ...any) {
+	logf(LevelInfo, "INFO", format, v...)
+}
+
+func Warnf(format string, v ...any) {
+	logf(LevelWarn, "WARN", format, v...)
+}
+
+func Errorf(format string, v ...any) {
+	logf(LevelError, "ERROR", format, v...)
+}
+
+// Fatalf always logs, then exits.
+func Fatalf(format string, v ...any) {
+	log.Fatalf("FATAL "+format, v...)
+}
@@ -0,0 +1,215 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"clickhouse.com/clickv/internal/clickos"
+)
+
+func TestClickOS_ParseInputTSV(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		syscallN uint32
+		bytes    []byte
+		id       uint64
+		wantErr  bool
+	}{
+		{name: "empty payload", input: "0\t[]", syscallN: 0, bytes: []byte{}},
+		{name: "single byte", input: "11\t[7]", syscallN: 11, bytes: []byte{7}},
+		{name: "multiple bytes", input: "14\t[1,0,0,0,72,105]", syscallN: 14, bytes: []byte{1, 0, 0, 0, 72, 105}},
+		{name: "spaces between bytes", input: "13\t[1, 0, 0, 0]", syscallN: 13, bytes: []byte{1, 0, 0, 0}},
+		{name: "trailing whitespace", input: "13\t[1,0,0,0]\r\n", syscallN: 13, bytes: []byte{1, 0, 0, 0}},
+		{name: "max byte", input: "14\t[255]", syscallN: 14, bytes: []byte{255}},
+		{name: "request id", input: "14\t[1]\t42", syscallN: 14, bytes: []byte{1}, id: 42},
+		{name: "request id with empty payload", input: "0\t[]\t7\n", syscallN: 0, bytes: []byte{}, id: 7},
+		{name: "missing payload", input: "14", wantErr: true},
+		{name: "bad request id", input: "14\t[1]\t[2]", wantErr: true},
+		{name: "too many columns", input: "14\t[1]\t1\t2", wantErr: true},
+		{name: "bad syscall number", input: "abc\t[1]", wantErr: true},
+		{name: "negative syscall number", input: "-1\t[1]", wantErr: true},
+		{name: "byte out of range", input: "14\t[256]", wantErr: true},
+		{name: "bad byte", input: "14\t[1,x]", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := clickos.ParseInputTSV(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for %q, got %s", tt.input, req.DebugString())
+				}
+				return
+			}
+			failErr(t, err)
+
+			if req.SyscallN != tt.syscallN {
+				t.Fatalf("expected syscall %d, got %d", tt.syscallN, req.SyscallN)
+			}
+			if !bytes.Equal(req.Bytes, tt.bytes) || len(req.Bytes) != len(tt.bytes) {
+				t.Fatalf("expected bytes %v, got %v", tt.bytes, req.Bytes)
+			}
+			if req.ID != tt.id {
+				t.Fatalf("expected request id %d, got %d", tt.id, req.ID)
+			}
+		})
+	}
+}
+
+func TestClickOS_ParseInputTSV_empty_payload(t *testing.T) {
+	for _, input := range []string{"0\t[]", "0\t[ ]", "0\t [] "} {
+		req, err := clickos.ParseInputTSV(input)
+		failErr(t, err)
+
+		if len(req.Bytes) != 0 {
+			t.Fatalf("expected no bytes for %q, got %v", input, req.Bytes)
+		}
+	}
+}
+
+func TestClickOS_Serialize(t *testing.T) {
+	tests := []struct {
+		name     string
+		response clickos.SyscallResponse
+		expected string
+	}{
+		{name: "status only", response: clickos.SyscallResponse{Status: 3}, expected: "[3,0,0,0]"},
+		{name: "negative status", response: clickos.SyscallResponse{Status: -1}, expected: "[255,255,255,255]"},
+		{name: "status and bytes", response: clickos.SyscallResponse{Status: 2, Bytes: []byte{104, 105}}, expected: "[2,0,0,0,104,105]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := string(tt.response.Serialize())
+			if output != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, output)
+			}
+		})
+	}
+}
+
+func TestClickOS_Serialize_round_trip(t *testing.T) {
+	response := clickos.SyscallResponse{
+		SyscallN: clickos.SYSCALL_READ,
+		Status:   5,
+		Bytes:    []byte("Click"),
+	}
+
+	req, err := clickos.ParseInputTSV(fmt.Sprintf("%d\t%s", response.SyscallN, response.Serialize()))
+	failErr(t, err)
+
+	if req.SyscallN != response.SyscallN {
+		t.Fatalf("expected syscall %d, got %d", response.SyscallN, req.SyscallN)
+	}
+
+	expected := append(uint32Bytes(uint32(response.Status)), response.Bytes...)
+	if !bytes.Equal(req.Bytes, expected) {
+		t.Fatalf("expected bytes %v, got %v", expected, req.Bytes)
+	}
+}
+
+func TestClickOS_ChunkResponse_round_trip(t *testing.T) {
+	for _, size := range []int{0, 10, clickos.MaxDatagramSize, 3 * clickos.MaxDatagramSize} {
+		resp := bytes.Repeat([]byte{'7'}, size)
+		chunks := clickos.ChunkResponse(resp)
+
+		var reassembled []byte
+		for i, chunk := range chunks {
+			if len(chunk) > clickos.MaxDatagramSize {
+				t.Fatalf("size %d: chunk %d is %d bytes, over the datagram limit", size, i, len(chunk))
+			}
+			seq, total, body, err := clickos.ParseChunk(chunk)
+			failErr(t, err)
+			if seq != i || total != len(chunks) {
+				t.Fatalf("size %d: expected chunk %d/%d, got %d/%d", size, i, len(chunks), seq, total)
+			}
+			reassembled = append(reassembled, body...)
+		}
+
+		if !bytes.Equal(reassembled, resp) {
+			t.Fatalf("size %d: reassembled %d bytes, expected %d", size, len(reassembled), len(resp))
+		}
+	}
+}
+
+func TestClickOS_ParseChunk_invalid(t *testing.T) {
+	for _, datagram := range []string{"[0,0,0,0]", "1\t[]", "a/2\t[]", "2/2\t[]", "-1/2\t[]", "0/0\t[]"} {
+		_, _, _, err := clickos.ParseChunk([]byte(datagram))
+		if !errors.Is(err, clickos.ErrBadPayload) {
+			t.Fatalf("expected %q to be rejected with ErrBadPayload, got %v", datagram, err)
+		}
+	}
+}
+
+func TestClickOS_HexDump(t *testing.T) {
+	dump := clickos.HexDump([]byte("./doom1.wad\x00\x00\x00\x00\x00\x01"))
+	expected := "00000000  2e 2f 64 6f 6f 6d 31 2e  77 61 64 00 00 00 00 00  |./doom1.wad.....|\n" +
+		"00000010  01                                                |.|\n"
+	if dump != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, dump)
+	}
+}
+
+func TestClickOS_ReadCStringN(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      []byte
+		max        int
+		expected   string
+		terminated bool
+	}{
+		{name: "terminated", input: []byte("file.txt\x00\x01\x02"), max: 64, expected: "file.txt", terminated: true},
+		{name: "empty string", input: []byte{0}, max: 64, expected: "", terminated: true},
+		{name: "end of input", input: []byte("file.txt"), max: 64, expected: "file.txt", terminated: false},
+		{name: "hits max", input: []byte("file.txt\x00"), max: 4, expected: "file", terminated: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, terminated := clickos.ReadCStringN(tt.input, tt.max)
+			if value != tt.expected || terminated != tt.terminated {
+				t.Fatalf("expected (%q, %t), got (%q, %t)", tt.expected, tt.terminated, value, terminated)
+			}
+		})
+	}
+}
+
+func TestClickOS_open_unterminated_path(t *testing.T) {
+	// Path without a NUL, the flags would have been read as part of the path
+	payload := append([]byte("file.txt"), uint32Bytes(0x01010101)...)
+	_, err := clickos.MuxCall(&clickos.SyscallRequest{SyscallN: clickos.SYSCALL_OPEN, Bytes: payload})
+	if err == nil {
+		t.Fatalf("expected unterminated path to be rejected")
+	}
+}
+
+func TestClickOS_error_kinds(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      clickos.SyscallRequest
+		expected error
+	}{
+		{"unknown syscall", clickos.SyscallRequest{SyscallN: 9999}, clickos.ErrUnknownSyscall},
+		{"short read", clickos.SyscallRequest{SyscallN: clickos.SYSCALL_READ, Bytes: uint32Bytes(1)}, clickos.ErrShortPayload},
+		{"unterminated path", clickos.SyscallRequest{SyscallN: clickos.SYSCALL_UNLINK, Bytes: []byte("file.txt")}, clickos.ErrBadPayload},
+		{"closed fd", clickos.SyscallRequest{SyscallN: clickos.SYSCALL_READ, Bytes: uint32Bytes(99, 4)}, clickos.ErrBadFd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := clickos.MuxCall(&tt.req)
+			if !errors.Is(err, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, err)
+			}
+			if !clickos.IsClientError(err) {
+				t.Fatalf("expected %v to be a client error", err)
+			}
+		})
+	}
+
+	if clickos.IsClientError(fmt.Errorf("failed to read file: %w", clickos.ErrIO)) {
+		t.Fatalf("expected ErrIO not to be a client error")
+	}
+}
@@ -0,0 +1,824 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"clickhouse.com/clickv/internal/clickos"
+)
+
+/**
+ * These tests drive ClickOS through MuxCall, the same entry point the server uses.
+ * They don't need ClickHouse.
+ */
+
+func uint32Bytes(values ...uint32) []byte {
+	out := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(out[i*4:], v)
+	}
+	return out
+}
+
+func muxCall(t *testing.T, syscallN uint32, payload []byte) *clickos.SyscallResponse {
+	resp, err := clickos.MuxCall(&clickos.SyscallRequest{SyscallN: syscallN, Bytes: payload})
+	failErr(t, err)
+
+	return resp
+}
+
+func openFile(t *testing.T, pathName string) int32 {
+	payload := append([]byte(pathName), 0)
+	payload = append(payload, uint32Bytes(0)...)
+	resp := muxCall(t, clickos.SYSCALL_OPEN, payload)
+	if resp.Status <= 0 {
+		t.Fatalf("expected a file descriptor, got %d", resp.Status)
+	}
+
+	return resp.Status
+}
+
+func writeTempFile(t *testing.T, name string, contents []byte) string {
+	pathName := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(pathName, contents, 0666)
+	failErr(t, err)
+
+	return pathName
+}
+
+func resetClickOS(t *testing.T) {
+	muxCall(t, clickos.SYSCALL_RESET, nil)
+}
+
+func TestClickOS_read_advances_offset(t *testing.T) {
+	defer resetClickOS(t)
+
+	contents := []byte("ClickHouse!")
+	fd := openFile(t, writeTempFile(t, "read.txt", contents))
+
+	var read []byte
+	for i := 0; i < 3; i++ {
+		resp := muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fd), 4))
+		if int(resp.Status) != len(resp.Bytes) {
+			t.Fatalf("expected status to equal bytes read (%d), got %d", len(resp.Bytes), resp.Status)
+		}
+		read = append(read, resp.Bytes...)
+	}
+
+	if string(read) != string(contents) {
+		t.Fatalf("expected to read %q, got %q", contents, read)
+	}
+
+	resp := muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fd), 4))
+	if resp.Status != 0 || len(resp.Bytes) != 0 {
+		t.Fatalf("expected EOF read to return 0 bytes, got status %d with %d bytes", resp.Status, len(resp.Bytes))
+	}
+}
+
+func TestClickOS_read_count_clamped(t *testing.T) {
+	defer resetClickOS(t)
+	defer func(max uint32) { clickos.MaxReadCount = max }(clickos.MaxReadCount)
+
+	fd := openFile(t, writeTempFile(t, "clamp.txt", []byte("ClickHouse!")))
+
+	// A 4GB count must not be allocated up front
+	resp := muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fd), 0xFFFFFFFF))
+	if resp.Status != 11 || string(resp.Bytes) != "ClickHouse!" {
+		t.Fatalf("expected the whole file, got %d %q", resp.Status, resp.Bytes)
+	}
+
+	clickos.MaxReadCount = 4
+	resp = muxCall(t, clickos.SYSCALL_PREAD, uint32Bytes(uint32(fd), 0, 0xFFFFFFFF))
+	if resp.Status != 4 || string(resp.Bytes) != "Clic" {
+		t.Fatalf("expected a 4 byte pread, got %d %q", resp.Status, resp.Bytes)
+	}
+
+	muxCall(t, clickos.SYSCALL_SEEK, uint32Bytes(uint32(fd), 0, 0))
+	resp = muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fd), 0xFFFFFFFF))
+	if resp.Status != 4 || string(resp.Bytes) != "Clic" {
+		t.Fatalf("expected a 4 byte read, got %d %q", resp.Status, resp.Bytes)
+	}
+}
+
+func TestClickOS_open_missing_file(t *testing.T) {
+	defer resetClickOS(t)
+	defer func() { clickos.CreateOnOpen = false }()
+
+	pathName := filepath.Join(t.TempDir(), "doom1.wad")
+	openPayload := func(flags int32) []byte {
+		return append(append([]byte(pathName), 0), uint32Bytes(uint32(flags))...)
+	}
+
+	resp := muxCall(t, clickos.SYSCALL_OPEN, openPayload(0))
+	if resp.Status != clickos.ERRNO_ENOENT {
+		t.Fatalf("expected ENOENT without O_CREAT, got %d", resp.Status)
+	}
+	if _, err := os.Stat(pathName); !os.IsNotExist(err) {
+		t.Fatalf("expected the file not to be created, stat returned %v", err)
+	}
+
+	resp = muxCall(t, clickos.SYSCALL_OPEN, openPayload(clickos.OPEN_O_CREAT))
+	if resp.Status <= 0 {
+		t.Fatalf("expected O_CREAT to create the file, got %d", resp.Status)
+	}
+
+	clickos.CreateOnOpen = true
+	resp = muxCall(t, clickos.SYSCALL_OPEN, append(append([]byte(pathName+".2"), 0), uint32Bytes(0)...))
+	if resp.Status <= 0 {
+		t.Fatalf("expected CreateOnOpen to create the file, got %d", resp.Status)
+	}
+}
+
+func TestClickOS_seek_end(t *testing.T) {
+	defer resetClickOS(t)
+
+	contents := []byte("ClickHouse!")
+	fd := openFile(t, writeTempFile(t, "seek.txt", contents))
+
+	resp := muxCall(t, clickos.SYSCALL_SEEK, uint32Bytes(uint32(fd), 0, uint32(clickos.SEEK_END)))
+	if int(resp.Status) != len(contents) {
+		t.Fatalf("expected SEEK_END to return %d, got %d", len(contents), resp.Status)
+	}
+
+	offset := int32(-3)
+	resp = muxCall(t, clickos.SYSCALL_SEEK, uint32Bytes(uint32(fd), uint32(offset), uint32(clickos.SEEK_END)))
+	if int(resp.Status) != len(contents)-3 {
+		t.Fatalf("expected SEEK_END-3 to return %d, got %d", len(contents)-3, resp.Status)
+	}
+}
+
+// The guest libc idiom for file size: save the position, seek to the end, then restore
+func TestClickOS_seek_end_size_then_restore(t *testing.T) {
+	defer resetClickOS(t)
+
+	contents := []byte("ClickHouse!")
+	fd := openFile(t, writeTempFile(t, "size.txt", contents))
+	seek := func(offset int32, whence int32) int32 {
+		return muxCall(t, clickos.SYSCALL_SEEK, uint32Bytes(uint32(fd), uint32(offset), uint32(whence))).Status
+	}
+
+	muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fd), 4))
+	saved := seek(0, clickos.SEEK_CUR)
+	if saved != 4 {
+		t.Fatalf("expected SEEK_CUR to report 4, got %d", saved)
+	}
+
+	if size := seek(0, clickos.SEEK_END); int(size) != len(contents) {
+		t.Fatalf("expected SEEK_END to return the size %d, got %d", len(contents), size)
+	}
+	resp := muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fd), 16))
+	if resp.Status != 0 {
+		t.Fatalf("expected a read at the end to return 0, got %d", resp.Status)
+	}
+
+	if restored := seek(saved, clickos.SEEK_SET); restored != saved {
+		t.Fatalf("expected SEEK_SET to return %d, got %d", saved, restored)
+	}
+	resp = muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fd), 16))
+	if string(resp.Bytes) != "kHouse!" {
+		t.Fatalf("expected to read from the restored position, got %q", resp.Bytes)
+	}
+
+	descriptors := clickos.ListDescriptors()
+	if len(descriptors) != 1 || int(descriptors[0].Seek) != len(contents) {
+		t.Fatalf("expected the tracked position to be %d, got %+v", len(contents), descriptors)
+	}
+}
+
+func TestClickOS_seek_invalid_whence(t *testing.T) {
+	defer resetClickOS(t)
+
+	fd := openFile(t, writeTempFile(t, "seek.txt", []byte("ClickHouse!")))
+
+	resp := muxCall(t, clickos.SYSCALL_SEEK, uint32Bytes(uint32(fd), 0, 3))
+	if resp.Status != clickos.ERRNO_EINVAL {
+		t.Fatalf("expected invalid whence to return %d, got %d", clickos.ERRNO_EINVAL, resp.Status)
+	}
+}
+
+func TestClickOS_pread(t *testing.T) {
+	defer resetClickOS(t)
+
+	fd := openFile(t, writeTempFile(t, "pread.txt", []byte("ClickHouse!")))
+
+	resp := muxCall(t, clickos.SYSCALL_PREAD, uint32Bytes(uint32(fd), 5, 5))
+	if string(resp.Bytes) != "House" || resp.Status != 5 {
+		t.Fatalf("expected pread at 5 to return %q, got %q (status %d)", "House", resp.Bytes, resp.Status)
+	}
+
+	// The file position is untouched, a plain read still starts at 0
+	resp = muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fd), 5))
+	if string(resp.Bytes) != "Click" {
+		t.Fatalf("expected read after pread to return %q, got %q", "Click", resp.Bytes)
+	}
+
+	resp = muxCall(t, clickos.SYSCALL_PREAD, uint32Bytes(uint32(fd), 8, 16))
+	if string(resp.Bytes) != "se!" || resp.Status != 3 {
+		t.Fatalf("expected pread past the end to return %q, got %q (status %d)", "se!", resp.Bytes, resp.Status)
+	}
+}
+
+func TestClickOS_ftruncate(t *testing.T) {
+	defer resetClickOS(t)
+
+	pathName := writeTempFile(t, "save.dat", nil)
+	fd := openFile(t, pathName)
+	muxCall(t, clickos.SYSCALL_WRITE, append(uint32Bytes(uint32(fd)), []byte("ClickHouse!")...))
+
+	resp := muxCall(t, clickos.SYSCALL_FTRUNCATE, uint32Bytes(uint32(fd), 5))
+	if resp.Status != 0 {
+		t.Fatalf("expected ftruncate to return 0, got %d", resp.Status)
+	}
+
+	contents, err := os.ReadFile(pathName)
+	failErr(t, err)
+	if string(contents) != "Click" {
+		t.Fatalf("expected truncated file to contain %q, got %q", "Click", contents)
+	}
+
+	length := int32(-1)
+	resp = muxCall(t, clickos.SYSCALL_FTRUNCATE, uint32Bytes(uint32(fd), uint32(length)))
+	if resp.Status != clickos.ERRNO_EINVAL {
+		t.Fatalf("expected negative length to return %d, got %d", clickos.ERRNO_EINVAL, resp.Status)
+	}
+}
+
+func cString(values ...string) []byte {
+	var out []byte
+	for _, v := range values {
+		out = append(out, v...)
+		out = append(out, 0)
+	}
+	return out
+}
+
+// chdirTemp runs the rest of the test in a new temp directory, the filesystem syscalls only take relative paths
+func chdirTemp(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	failErr(t, err)
+	failErr(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	return dir
+}
+
+func TestClickOS_filesystem(t *testing.T) {
+	chdirTemp(t)
+	saves := "saves"
+	oldPath := filepath.Join(saves, "slot0.tmp")
+	newPath := filepath.Join(saves, "slot0.dsg")
+
+	resp := muxCall(t, clickos.SYSCALL_MKDIR, append(cString(saves), uint32Bytes(0755)...))
+	if resp.Status != 0 {
+		t.Fatalf("expected mkdir to return 0, got %d", resp.Status)
+	}
+	resp = muxCall(t, clickos.SYSCALL_MKDIR, append(cString(saves), uint32Bytes(0755)...))
+	if resp.Status != clickos.ERRNO_EEXIST {
+		t.Fatalf("expected second mkdir to return %d, got %d", clickos.ERRNO_EEXIST, resp.Status)
+	}
+
+	failErr(t, os.WriteFile(oldPath, []byte("save"), 0666))
+	resp = muxCall(t, clickos.SYSCALL_RENAME, cString(oldPath, newPath))
+	if resp.Status != 0 {
+		t.Fatalf("expected rename to return 0, got %d", resp.Status)
+	}
+	if _, err := os.Stat(newPath); err != nil {
+		t.Fatalf("expected %s to exist after rename: %v", newPath, err)
+	}
+
+	resp = muxCall(t, clickos.SYSCALL_UNLINK, cString(saves))
+	if resp.Status != clickos.ERRNO_EISDIR {
+		t.Fatalf("expected unlink of a directory to return %d, got %d", clickos.ERRNO_EISDIR, resp.Status)
+	}
+	resp = muxCall(t, clickos.SYSCALL_UNLINK, cString(newPath))
+	if resp.Status != 0 {
+		t.Fatalf("expected unlink to return 0, got %d", resp.Status)
+	}
+	resp = muxCall(t, clickos.SYSCALL_UNLINK, cString(newPath))
+	if resp.Status != clickos.ERRNO_ENOENT {
+		t.Fatalf("expected unlink of a missing file to return %d, got %d", clickos.ERRNO_ENOENT, resp.Status)
+	}
+
+	_, err := clickos.MuxCall(&clickos.SyscallRequest{SyscallN: clickos.SYSCALL_RENAME, Bytes: append(cString(oldPath), 'x')})
+	if err == nil {
+		t.Fatalf("expected rename with an unterminated new path to be rejected")
+	}
+}
+
+func TestClickOS_filesystem_escaping_paths(t *testing.T) {
+	dir := chdirTemp(t)
+	failErr(t, os.Mkdir("saves", 0755))
+	failErr(t, os.WriteFile(filepath.Join("saves", "slot0.dsg"), []byte("save"), 0666))
+
+	// Absolute, or relative but leaving the working directory at some point
+	outside := filepath.Join(dir, "saves", "slot0.dsg")
+	for _, pathName := range []string{outside, "../slot0.dsg", "saves/../saves/slot0.dsg", ".."} {
+		resp := muxCall(t, clickos.SYSCALL_UNLINK, cString(pathName))
+		if resp.Status != clickos.ERRNO_EACCES {
+			t.Fatalf("expected unlink of %q to return %d, got %d", pathName, clickos.ERRNO_EACCES, resp.Status)
+		}
+
+		resp = muxCall(t, clickos.SYSCALL_RENAME, cString("saves/slot0.dsg", pathName))
+		if resp.Status != clickos.ERRNO_EACCES {
+			t.Fatalf("expected rename to %q to return %d, got %d", pathName, clickos.ERRNO_EACCES, resp.Status)
+		}
+		resp = muxCall(t, clickos.SYSCALL_RENAME, cString(pathName, "saves/slot1.dsg"))
+		if resp.Status != clickos.ERRNO_EACCES {
+			t.Fatalf("expected rename from %q to return %d, got %d", pathName, clickos.ERRNO_EACCES, resp.Status)
+		}
+
+		newDir := pathName + "/dir"
+		resp = muxCall(t, clickos.SYSCALL_MKDIR, append(cString(newDir), uint32Bytes(0755)...))
+		if resp.Status != clickos.ERRNO_EACCES {
+			t.Fatalf("expected mkdir of %q to return %d, got %d", newDir, clickos.ERRNO_EACCES, resp.Status)
+		}
+	}
+
+	if data, err := os.ReadFile(outside); err != nil || string(data) != "save" {
+		t.Fatalf("expected the save to be untouched, got %q: %v", data, err)
+	}
+}
+
+func TestClickOS_fdlist(t *testing.T) {
+	defer resetClickOS(t)
+
+	pathName := writeTempFile(t, "fdlist.txt", []byte("ClickHouse!"))
+	fileFd := openFile(t, pathName)
+	muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fileFd), 5))
+	socketFd, listener, _ := openSocket(t)
+
+	resp := muxCall(t, clickos.SYSCALL_FDLIST, nil)
+	if resp.Status != 2 {
+		t.Fatalf("expected 2 descriptors, got %d", resp.Status)
+	}
+
+	expected := []clickos.DescriptorInfo{
+		{ID: fileFd, Type: 0, Name: pathName, Seek: 5},
+		{ID: socketFd, Type: 1, Name: listener.LocalAddr().String(), Seek: 0},
+	}
+	payload := resp.Bytes
+	for _, want := range expected {
+		if len(payload) < 13 {
+			t.Fatalf("expected an entry for fd %d, payload ran out", want.ID)
+		}
+		got := clickos.DescriptorInfo{
+			ID:   int32(binary.LittleEndian.Uint32(payload[0:4])),
+			Type: payload[4],
+			Seek: int32(binary.LittleEndian.Uint32(payload[5:9])),
+		}
+		nameLen := int(binary.LittleEndian.Uint32(payload[9:13]))
+		got.Name = string(payload[13 : 13+nameLen])
+		payload = payload[13+nameLen:]
+
+		if got != want {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+	if len(payload) != 0 {
+		t.Fatalf("expected no trailing bytes, got %d", len(payload))
+	}
+}
+
+// sqlRoutedSyscalls lists the syscalls an ecall view in sql/click-v.sql forwards
+func sqlRoutedSyscalls(t *testing.T) map[uint32]bool {
+	sql, err := os.ReadFile("../../sql/click-v.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routed := map[uint32]bool{}
+	for _, match := range regexp.MustCompile(`syscall_n (?:= (\w+)|IN \(([^)]*)\))`).FindAllStringSubmatch(string(sql), -1) {
+		for _, n := range strings.Split(match[1]+match[2], ",") {
+			syscallN, err := strconv.ParseUint(strings.TrimSpace(n), 0, 32)
+			if err != nil {
+				t.Fatalf("bad syscall number in ecall filter %q: %v", match[0], err)
+			}
+			routed[uint32(syscallN)] = true
+		}
+	}
+	return routed
+}
+
+func TestClickOS_capabilities(t *testing.T) {
+	defer resetClickOS(t)
+	defer func() { clickos.LibcStubs = false }()
+
+	routed := sqlRoutedSyscalls(t)
+	for _, libcStubs := range []bool{false, true} {
+		clickos.LibcStubs = libcStubs
+		resp := muxCall(t, clickos.SYSCALL_CAPABILITIES, nil)
+		if int(resp.Status) != len(resp.Bytes) {
+			t.Fatalf("expected status to be the mask length %d, got %d", len(resp.Bytes), resp.Status)
+		}
+
+		isAdvertised := func(syscallN uint32) bool {
+			return syscallN/8 < uint32(len(resp.Bytes)) && resp.Bytes[syscallN/8]&(1<<(syscallN%8)) != 0
+		}
+		// RESET is host-only, the ecall filter drops syscall 0
+		if isAdvertised(clickos.SYSCALL_RESET) {
+			t.Fatalf("expected RESET not to be advertised")
+		}
+		if !isAdvertised(clickos.SYSCALL_WRITEV) {
+			t.Fatalf("expected WRITEV to be advertised")
+		}
+
+		for syscallN := uint32(0); syscallN < uint32(len(resp.Bytes))*8; syscallN++ {
+			advertised := isAdvertised(syscallN)
+			if advertised && !routed[syscallN] {
+				t.Fatalf("syscall %d is advertised but no ecall view forwards it", syscallN)
+			}
+			if syscallN == clickos.SYSCALL_PRINT || syscallN == clickos.SYSCALL_DRAW {
+				if !advertised {
+					t.Fatalf("expected %s to be advertised", clickos.SyscallToName(syscallN))
+				}
+				continue // handled in SQL, never reaches MuxCall
+			}
+
+			// Decoders reject the empty payload, but with ErrShortPayload rather than ErrUnknownSyscall
+			_, err := clickos.MuxCall(&clickos.SyscallRequest{SyscallN: syscallN})
+			handled := !errors.Is(err, clickos.ErrUnknownSyscall)
+			if advertised != (handled && routed[syscallN]) {
+				t.Fatalf("libc stubs %v: syscall %d advertised %v but handled %v and routed %v", libcStubs, syscallN, advertised, handled, routed[syscallN])
+			}
+		}
+	}
+}
+
+func TestClickOS_record_replay(t *testing.T) {
+	defer resetClickOS(t)
+
+	pathName := writeTempFile(t, "replay.txt", []byte("ClickHouse!"))
+	requests := []*clickos.SyscallRequest{
+		{SyscallN: clickos.SYSCALL_OPEN, Bytes: append(append([]byte(pathName), 0), uint32Bytes(0)...)},
+		{SyscallN: clickos.SYSCALL_READ, Bytes: uint32Bytes(1, 5)},
+		{SyscallN: clickos.SYSCALL_SEEK, Bytes: uint32Bytes(1, 6, 0)},
+		{SyscallN: clickos.SYSCALL_READ, Bytes: uint32Bytes(1, 16)},
+		{SyscallN: clickos.SYSCALL_CLOSE, Bytes: uint32Bytes(1)},
+		{SyscallN: clickos.SYSCALL_CLOSE, Bytes: uint32Bytes(99)}, // fails
+	}
+	// What each call should do, so a replay that reproduces failures can't pass
+	expected := []clickos.Record{
+		{Status: 1}, // the fd the requests above use
+		{Status: 5, Response: []byte("Click")},
+		{Status: 6},
+		{Status: 5, Response: []byte("ouse!")},
+		{Status: 0},
+		{Status: -1, Failed: true},
+	}
+
+	var log bytes.Buffer
+	for i, req := range requests {
+		resp, err := clickos.MuxCall(req)
+		rec := clickos.NewRecord(req, resp, err)
+		expected[i].SyscallN, expected[i].Request = req.SyscallN, req.Bytes
+		if !rec.Equal(expected[i]) {
+			t.Fatalf("call %d: expected %s, got %s", i, expected[i].DebugString(), rec.DebugString())
+		}
+		failErr(t, clickos.WriteRecord(&log, rec))
+	}
+	recorded := log.Bytes()
+	resetClickOS(t)
+
+	reader := bytes.NewReader(recorded)
+	for i := range requests {
+		rec, err := clickos.ReadRecord(reader)
+		failErr(t, err)
+
+		req := &clickos.SyscallRequest{SyscallN: rec.SyscallN, Bytes: rec.Request}
+		resp, err := clickos.MuxCall(req)
+		if got := clickos.NewRecord(req, resp, err); !got.Equal(rec) {
+			t.Fatalf("record %d: recorded %s, replayed %s", i, rec.DebugString(), got.DebugString())
+		}
+	}
+	if _, err := clickos.ReadRecord(reader); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected io.EOF after the last record, got %v", err)
+	}
+
+	truncated := bytes.NewReader(recorded[:20])
+	if _, err := clickos.ReadRecord(truncated); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF for a cut-off record, got %v", err)
+	}
+}
+
+func TestClickOS_libc_stubs(t *testing.T) {
+	clickos.LibcStubs = false
+	_, err := clickos.MuxCall(&clickos.SyscallRequest{SyscallN: clickos.SYSCALL_GETPID})
+	if err == nil {
+		t.Fatalf("expected GETPID to fail with libc stubs disabled")
+	}
+
+	clickos.LibcStubs = true
+	defer func() { clickos.LibcStubs = false }()
+
+	tests := map[uint32]int32{
+		clickos.SYSCALL_GETPID:          1,
+		clickos.SYSCALL_GETTID:          1,
+		clickos.SYSCALL_SET_TID_ADDRESS: 1,
+		clickos.SYSCALL_GETPPID:         0,
+		clickos.SYSCALL_GETUID:          0,
+		clickos.SYSCALL_GETEGID:         0,
+	}
+	for syscallN, expected := range tests {
+		resp := muxCall(t, syscallN, uint32Bytes(0))
+		if resp.Status != expected {
+			t.Fatalf("expected %s to return %d, got %d", clickos.SyscallToName(syscallN), expected, resp.Status)
+		}
+	}
+}
+
+func TestClickOS_ioctl(t *testing.T) {
+	resp := muxCall(t, clickos.SYSCALL_IOCTL, uint32Bytes(1, clickos.TIOCGWINSZ))
+	if resp.Status != 0 || len(resp.Bytes) != 8 {
+		t.Fatalf("expected TIOCGWINSZ on stdout to return a winsize, got status %d with %d bytes", resp.Status, len(resp.Bytes))
+	}
+	rows := binary.LittleEndian.Uint16(resp.Bytes[0:])
+	cols := binary.LittleEndian.Uint16(resp.Bytes[2:])
+	if rows != clickos.TERMINAL_ROWS || cols != clickos.TERMINAL_COLS {
+		t.Fatalf("expected %dx%d, got %dx%d", clickos.TERMINAL_ROWS, clickos.TERMINAL_COLS, rows, cols)
+	}
+
+	resp = muxCall(t, clickos.SYSCALL_IOCTL, uint32Bytes(2, clickos.TCGETS))
+	if resp.Status != 0 {
+		t.Fatalf("expected stderr to be a tty, got %d", resp.Status)
+	}
+
+	resp = muxCall(t, clickos.SYSCALL_IOCTL, uint32Bytes(5, clickos.TCGETS))
+	if resp.Status != clickos.ERRNO_ENOTTY {
+		t.Fatalf("expected fd 5 to return %d, got %d", clickos.ERRNO_ENOTTY, resp.Status)
+	}
+}
+
+func writevPayload(fd int32, segments ...[]byte) []byte {
+	payload := uint32Bytes(uint32(fd), uint32(len(segments)))
+	for _, segment := range segments {
+		payload = append(payload, uint32Bytes(uint32(len(segment)))...)
+		payload = append(payload, segment...)
+	}
+	return payload
+}
+
+func TestClickOS_writev(t *testing.T) {
+	defer resetClickOS(t)
+
+	pathName := writeTempFile(t, "writev.txt", nil)
+	fd := openFile(t, pathName)
+
+	resp := muxCall(t, clickos.SYSCALL_WRITEV, writevPayload(fd, []byte("Click"), []byte{}, []byte("House!")))
+	if resp.Status != 11 {
+		t.Fatalf("expected 11 bytes written, got %d", resp.Status)
+	}
+
+	contents, err := os.ReadFile(pathName)
+	failErr(t, err)
+	if string(contents) != "ClickHouse!" {
+		t.Fatalf("expected file to contain %q, got %q", "ClickHouse!", contents)
+	}
+}
+
+func TestClickOS_writev_malformed(t *testing.T) {
+	defer resetClickOS(t)
+
+	fd := openFile(t, writeTempFile(t, "writev.txt", nil))
+
+	valid := writevPayload(fd, []byte("Click"))
+	tests := map[string][]byte{
+		"too short":        uint32Bytes(uint32(fd)),
+		"missing segment":  uint32Bytes(uint32(fd), 2),
+		"length too large": append(uint32Bytes(uint32(fd), 1, 0xFFFFFFFF), 'a'),
+		"truncated":        valid[:len(valid)-1],
+		"trailing bytes":   append(valid, 0),
+		"too many":         uint32Bytes(uint32(fd), clickos.MAX_WRITEV_SEGMENTS+1),
+	}
+	for name, payload := range tests {
+		_, err := clickos.MuxCall(&clickos.SyscallRequest{SyscallN: clickos.SYSCALL_WRITEV, Bytes: payload})
+		if err == nil {
+			t.Fatalf("%s: expected malformed writev to be rejected", name)
+		}
+	}
+}
+
+func TestClickOS_getrandom_seeded(t *testing.T) {
+	clickos.SeedRandom(1854)
+	first := muxCall(t, clickos.SYSCALL_GETRANDOM, uint32Bytes(16))
+	if first.Status != 16 || len(first.Bytes) != 16 {
+		t.Fatalf("expected 16 random bytes, got status %d with %d bytes", first.Status, len(first.Bytes))
+	}
+
+	clickos.SeedRandom(1854)
+	second := muxCall(t, clickos.SYSCALL_GETRANDOM, uint32Bytes(16))
+	if string(first.Bytes) != string(second.Bytes) {
+		t.Fatalf("expected the same seed to produce the same bytes, got %v and %v", first.Bytes, second.Bytes)
+	}
+
+	resp := muxCall(t, clickos.SYSCALL_GETRANDOM, uint32Bytes(clickos.MAX_GETRANDOM_LEN+1))
+	if resp.Status != int32(clickos.MAX_GETRANDOM_LEN) || len(resp.Bytes) != int(clickos.MAX_GETRANDOM_LEN) {
+		t.Fatalf("expected request to be clamped to %d bytes, got status %d with %d bytes", clickos.MAX_GETRANDOM_LEN, resp.Status, len(resp.Bytes))
+	}
+}
+
+// openSocket connects a guest socket to a local listener and returns the fd plus the pipe's address,
+// learned from a first datagram written by the guest.
+func TestClickOS_getrandom_concurrent(t *testing.T) {
+	const calls = 32
+	collect := func(concurrent bool) map[string]bool {
+		clickos.SeedRandom(1870)
+		chunks := make(chan string, calls)
+		var wg sync.WaitGroup
+		for i := 0; i < calls; i++ {
+			call := func() {
+				defer wg.Done()
+				resp, err := clickos.MuxCall(&clickos.SyscallRequest{SyscallN: clickos.SYSCALL_GETRANDOM, Bytes: uint32Bytes(16)})
+				if err != nil {
+					t.Errorf("GETRANDOM failed: %v", err)
+					return
+				}
+				chunks <- string(resp.Bytes)
+			}
+			wg.Add(1)
+			if concurrent {
+				go call()
+			} else {
+				call()
+			}
+		}
+		wg.Wait()
+		close(chunks)
+
+		seen := make(map[string]bool, calls)
+		for chunk := range chunks {
+			seen[chunk] = true
+		}
+		return seen
+	}
+
+	// Calls may finish in any order, but each must take a whole chunk of the seeded sequence
+	sequential, concurrent := collect(false), collect(true)
+	if len(sequential) != calls || len(concurrent) != calls {
+		t.Fatalf("expected %d distinct chunks, got %d sequential and %d concurrent", calls, len(sequential), len(concurrent))
+	}
+	for chunk := range concurrent {
+		if !sequential[chunk] {
+			t.Fatalf("concurrent call returned %v, which is not a chunk of the seeded sequence", []byte(chunk))
+		}
+	}
+}
+
+func openSocket(t *testing.T) (int32, *net.UDPConn, *net.UDPAddr) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	failErr(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	resp := muxCall(t, clickos.SYSCALL_SOCKET, append([]byte(listener.LocalAddr().String()), 0))
+	if resp.Status <= 0 {
+		t.Fatalf("expected a socket descriptor, got %d", resp.Status)
+	}
+	fd := resp.Status
+
+	muxCall(t, clickos.SYSCALL_WRITE, append(uint32Bytes(uint32(fd)), []byte("hello")...))
+	buf := make([]byte, 16)
+	failErr(t, listener.SetReadDeadline(time.Now().Add(2*time.Second)))
+	_, pipeAddr, err := listener.ReadFromUDP(buf)
+	failErr(t, err)
+
+	return fd, listener, pipeAddr
+}
+
+func TestClickOS_bootstrap_socket(t *testing.T) {
+	defer resetClickOS(t)
+
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	failErr(t, err)
+	defer listener.Close()
+	address := listener.LocalAddr().String()
+
+	failErr(t, clickos.BootstrapSocket(5, address))
+	if err := clickos.BootstrapSocket(5, address); err == nil {
+		t.Fatalf("expected bootstrapping over an open fd to fail")
+	}
+
+	resp := muxCall(t, clickos.SYSCALL_WRITE, append(uint32Bytes(5), []byte("resumed")...))
+	if resp.Status != 7 {
+		t.Fatalf("expected 7 bytes written, got %d", resp.Status)
+	}
+	buf := make([]byte, 16)
+	failErr(t, listener.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, _, err := listener.ReadFromUDP(buf)
+	failErr(t, err)
+	if string(buf[:n]) != "resumed" {
+		t.Fatalf("expected \"resumed\", got %q", buf[:n])
+	}
+
+	descriptors := clickos.ListDescriptors()
+	if len(descriptors) != 1 || descriptors[0].ID != 5 || descriptors[0].Name != address {
+		t.Fatalf("expected fd 5 at %s, got %+v", address, descriptors)
+	}
+
+	resp = muxCall(t, clickos.SYSCALL_SOCKET, append([]byte(address), 0))
+	if resp.Status != 6 {
+		t.Fatalf("expected the next socket to be fd 6, got %d", resp.Status)
+	}
+}
+
+func TestClickOS_pipe_full_policy(t *testing.T) {
+	defaultSize, defaultPolicy := clickos.PipeBufferSize, clickos.PipeFull
+	defer func() { clickos.PipeBufferSize, clickos.PipeFull = defaultSize, defaultPolicy }()
+
+	tests := []struct {
+		name   string
+		policy clickos.PipeFullPolicy
+		want   []string
+	}{
+		{"drop newest", clickos.PIPE_FULL_DROP_NEWEST, []string{"0", "1"}},
+		{"drop oldest", clickos.PIPE_FULL_DROP_OLDEST, []string{"3", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetClickOS(t)
+			clickos.PipeBufferSize, clickos.PipeFull = 2, tt.policy
+
+			fd, listener, pipeAddr := openSocket(t)
+			droppedBefore := clickos.DroppedPackets()
+			for i := 0; i < 5; i++ {
+				_, err := listener.WriteToUDP([]byte(strconv.Itoa(i)), pipeAddr)
+				failErr(t, err)
+			}
+
+			deadline := time.Now().Add(2 * time.Second)
+			for clickos.DroppedPackets()-droppedBefore < 3 {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected 3 dropped packets, got %d", clickos.DroppedPackets()-droppedBefore)
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			for _, want := range tt.want {
+				resp := muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fd), 16))
+				if string(resp.Bytes) != want {
+					t.Fatalf("expected to read %q, got %q (status %d)", want, resp.Bytes, resp.Status)
+				}
+			}
+
+			resp := muxCall(t, clickos.SYSCALL_READ, uint32Bytes(uint32(fd), 16))
+			if resp.Status != clickos.PIPE_EAGAIN || len(resp.Bytes) != 0 {
+				t.Fatalf("expected empty pipe to return EAGAIN, got status %d with %d bytes", resp.Status, len(resp.Bytes))
+			}
+		})
+	}
+}
+
+func TestClickOS_reset_closes_sockets(t *testing.T) {
+	fd, _, _ := openSocket(t)
+	resetClickOS(t)
+
+	_, err := clickos.MuxCall(&clickos.SyscallRequest{SyscallN: clickos.SYSCALL_READ, Bytes: uint32Bytes(uint32(fd), 16)})
+	if err == nil {
+		t.Fatalf("expected socket fd %d to be closed by reset", fd)
+	}
+}
+
+func TestClickOS_concurrent_writes(t *testing.T) {
+	defer resetClickOS(t)
+
+	const files = 8
+	const writes = 50
+
+	var wg sync.WaitGroup
+	pathNames := make([]string, files)
+	for i := range pathNames {
+		pathNames[i] = writeTempFile(t, "concurrent.txt", nil)
+		fd := openFile(t, pathNames[i])
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				_, err := clickos.MuxCall(&clickos.SyscallRequest{SyscallN: clickos.SYSCALL_WRITE, Bytes: append(uint32Bytes(uint32(fd)), 'x')})
+				if err != nil {
+					t.Errorf("write to fd %d failed: %v", fd, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, pathName := range pathNames {
+		contents, err := os.ReadFile(pathName)
+		failErr(t, err)
+		if len(contents) != writes {
+			t.Fatalf("expected %d bytes in %s, got %d", writes, pathName, len(contents))
+		}
+	}
+}
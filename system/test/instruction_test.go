@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -21,50 +22,60 @@ const ROM_SIZE uint32 = 128                 // We don't need more than a few ins
 const RAM_SIZE uint32 = 32                  // With a wee bit of RAM
 const MEM_SIZE uint32 = ROM_SIZE + RAM_SIZE // bytes
 
+// Every test runs under a deadline so a hung ClickHouse fails the test instead of wedging the whole run.
+// Override with e.g. CLICKV_TEST_TIMEOUT=5m when clocking long programs.
+const testTimeoutEnv = "CLICKV_TEST_TIMEOUT"
+const defaultTestTimeout = 60 * time.Second
+
 var instructionPerf = make(map[string]time.Duration, 64)
+var instructionPerfLock sync.Mutex
+
+// Shared by every test. driver.Conn is a pool, so it's safe to use from parallel tests once opened.
 var reusableDB driver.Conn = nil
+var reusableDBErr error
+var reusableDBOnce sync.Once
 
 func getDB() (driver.Conn, error) {
-	if reusableDB == nil {
-		db, err := cdb.GetClickHouseConnection()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get ClickHouse connection: %w", err)
+	reusableDBOnce.Do(func() {
+		reusableDB, reusableDBErr = cdb.GetClickHouseConnection()
+		if reusableDBErr != nil {
+			reusableDBErr = fmt.Errorf("failed to get ClickHouse connection: %w", reusableDBErr)
 		}
+	})
 
-		reusableDB = db
-	}
-
-	return reusableDB, nil
+	return reusableDB, reusableDBErr
 }
 
-func resetCPU(ctx context.Context, db driver.Conn) error {
-	// Reset PC
-	err := db.Exec(ctx, "INSERT INTO clickv.pc (value) VALUES (0)")
-	if err != nil {
-		return fmt.Errorf("failed to reset PC: %w", err)
+// closeDB closes the shared connection if a test opened it
+func closeDB() {
+	if reusableDB == nil {
+		return
 	}
 
-	// Reset registers
-	err = db.Exec(ctx, "TRUNCATE TABLE clickv.registers SYNC")
+	err := reusableDB.Close()
 	if err != nil {
-		return fmt.Errorf("failed to clear registers: %w", err)
-	}
-	err = db.Exec(ctx, "INSERT INTO clickv.registers (address, value) SELECT number AS address, 0 AS value FROM numbers(1 + 31)")
-	if err != nil {
-		return fmt.Errorf("failed to zero registers: %w", err)
+		fmt.Printf("failed to close ClickHouse connection: %v\n", err)
 	}
+}
 
-	// Reset RAM
-	err = db.Exec(ctx, "TRUNCATE TABLE clickv.memory SYNC")
-	if err != nil {
-		return fmt.Errorf("failed to clear memory: %w", err)
-	}
-	err = db.Exec(ctx, "INSERT INTO clickv.memory (address, value) SELECT number AS address, 0 AS value FROM numbers(?)", MEM_SIZE)
-	if err != nil {
-		return fmt.Errorf("failed to zero memory: %w", err)
+func testContext(t *testing.T) context.Context {
+	timeout := defaultTestTimeout
+	if value, ok := os.LookupEnv(testTimeoutEnv); ok {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil {
+			t.Fatalf("invalid %s %q: %v", testTimeoutEnv, value, err)
+		}
 	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	t.Cleanup(cancel)
+
+	return ctx
+}
+
+func resetCPU(ctx context.Context, db driver.Conn) error {
+	return cdb.ResetClickHouseState(ctx, db, MEM_SIZE)
 }
 
 func loadProgram(ctx context.Context, db driver.Conn, reversed bool, programHex string) error {
@@ -87,7 +98,9 @@ func clockCPU(ctx context.Context, db driver.Conn, instructionName string) error
 		return fmt.Errorf("failed to clock CPU: %w", err)
 	}
 	dur := time.Since(start)
+	instructionPerfLock.Lock()
 	instructionPerf[instructionName] = dur
+	instructionPerfLock.Unlock()
 
 	return nil
 }
@@ -131,6 +144,20 @@ func getMemory(ctx context.Context, db driver.Conn, addr uint32) (byte, error) {
 	return value, nil
 }
 
+// getMemoryRange reads length bytes starting at addr in a single query
+func getMemoryRange(ctx context.Context, db driver.Conn, addr uint32, length uint32) ([]byte, error) {
+	var values []uint8
+	err := db.QueryRow(ctx, "SELECT groupArray(value) FROM (SELECT address, value FROM clickv.memory WHERE address >= ? AND address < ? ORDER BY address ASC)", addr, addr+length).Scan(&values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memory range: %w", err)
+	}
+	if uint32(len(values)) != length {
+		return nil, fmt.Errorf("failed to get memory range: expected %d bytes at %d, got %d", length, addr, len(values))
+	}
+
+	return values, nil
+}
+
 func setMemory(ctx context.Context, db driver.Conn, addr uint32, value byte) error {
 	err := db.Exec(ctx, "INSERT INTO clickv.memory (address, value) VALUES (?, ?)", addr, value)
 	if err != nil {
@@ -163,6 +190,16 @@ func reverseInstructions(programHex string) string {
 	return string(reversed)
 }
 
+// programHex lays out instruction words (as written in asm listings) in memory order, for loadProgram with reversed=false
+func programHex(instructions ...string) string {
+	var program string
+	for _, instruction := range instructions {
+		program += reverseInstructions(instruction)
+	}
+
+	return program
+}
+
 // regAddr returns the register address for a given name
 func regAddr(name string) uint8 {
 	switch name {
@@ -265,12 +302,20 @@ func assertRegisterEquals(t *testing.T, ctx context.Context, db driver.Conn, reg
 	}
 }
 
+func assertMemoryRangeEquals(t *testing.T, ctx context.Context, db driver.Conn, addr uint32, expected []byte) {
+	values, err := getMemoryRange(ctx, db, addr, uint32(len(expected)))
+	failErr(t, err)
+	for _, diff := range cdb.DiffMemory(expected, values) {
+		t.Errorf("Expected memory at %d: % X, Got: % X", addr+diff.Start, diff.Old, diff.New)
+	}
+}
+
 func subUInt32(a, b uint32) uint32 {
 	return a + (^b + 1)
 }
 
 func TestInstruction_add(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -292,7 +337,7 @@ func TestInstruction_add(t *testing.T) {
 }
 
 func TestInstruction_add_negative(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -316,7 +361,7 @@ func TestInstruction_add_negative(t *testing.T) {
 }
 
 func TestInstruction_sub(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -340,7 +385,7 @@ func TestInstruction_sub(t *testing.T) {
 }
 
 func TestInstruction_sub_negative(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -364,7 +409,7 @@ func TestInstruction_sub_negative(t *testing.T) {
 }
 
 func TestInstruction_xor(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -388,7 +433,7 @@ func TestInstruction_xor(t *testing.T) {
 }
 
 func TestInstruction_or(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -412,7 +457,7 @@ func TestInstruction_or(t *testing.T) {
 }
 
 func TestInstruction_and(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -436,7 +481,7 @@ func TestInstruction_and(t *testing.T) {
 }
 
 func TestInstruction_sll(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -460,7 +505,7 @@ func TestInstruction_sll(t *testing.T) {
 }
 
 func TestInstruction_srl(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -484,7 +529,7 @@ func TestInstruction_srl(t *testing.T) {
 }
 
 func TestInstruction_sra(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -508,7 +553,7 @@ func TestInstruction_sra(t *testing.T) {
 }
 
 func TestInstruction_slt(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -537,7 +582,7 @@ func TestInstruction_slt(t *testing.T) {
 }
 
 func TestInstruction_sltu(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -566,7 +611,7 @@ func TestInstruction_sltu(t *testing.T) {
 }
 
 func TestInstruction_addi(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -589,7 +634,7 @@ func TestInstruction_addi(t *testing.T) {
 }
 
 func TestInstruction_addi_negative(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -612,7 +657,7 @@ func TestInstruction_addi_negative(t *testing.T) {
 }
 
 func TestInstruction_xori(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -635,7 +680,7 @@ func TestInstruction_xori(t *testing.T) {
 }
 
 func TestInstruction_ori(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -658,7 +703,7 @@ func TestInstruction_ori(t *testing.T) {
 }
 
 func TestInstruction_andi(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -681,7 +726,7 @@ func TestInstruction_andi(t *testing.T) {
 }
 
 func TestInstruction_slli(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -704,7 +749,7 @@ func TestInstruction_slli(t *testing.T) {
 }
 
 func TestInstruction_srli(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -727,7 +772,7 @@ func TestInstruction_srli(t *testing.T) {
 }
 
 func TestInstruction_srai(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -750,7 +795,7 @@ func TestInstruction_srai(t *testing.T) {
 }
 
 func TestInstruction_slti(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -778,7 +823,7 @@ func TestInstruction_slti(t *testing.T) {
 }
 
 func TestInstruction_sltiu(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -806,7 +851,7 @@ func TestInstruction_sltiu(t *testing.T) {
 }
 
 func TestInstruction_lui(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -827,7 +872,7 @@ func TestInstruction_lui(t *testing.T) {
 }
 
 func TestInstruction_auipc(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -850,7 +895,7 @@ func TestInstruction_auipc(t *testing.T) {
 }
 
 func TestInstruction_lb(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -876,7 +921,7 @@ func TestInstruction_lb(t *testing.T) {
 }
 
 func TestInstruction_lh(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -902,7 +947,7 @@ func TestInstruction_lh(t *testing.T) {
 }
 
 func TestInstruction_lw(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -928,7 +973,7 @@ func TestInstruction_lw(t *testing.T) {
 }
 
 func TestInstruction_lbu(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -954,7 +999,7 @@ func TestInstruction_lbu(t *testing.T) {
 }
 
 func TestInstruction_lhu(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -980,7 +1025,7 @@ func TestInstruction_lhu(t *testing.T) {
 }
 
 func TestInstruction_sb(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1011,7 +1056,7 @@ func TestInstruction_sb(t *testing.T) {
 }
 
 func TestInstruction_sh(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1033,20 +1078,11 @@ func TestInstruction_sh(t *testing.T) {
 	failErr(t, err)
 
 	assertPCIncremented(t, ctx, db, 0)
-
-	memoryValue1, err := getMemory(ctx, db, ROM_SIZE+addr)
-	failErr(t, err)
-	memoryValue2, err := getMemory(ctx, db, ROM_SIZE+addr+1)
-	failErr(t, err)
-
-	result := (uint16(memoryValue2) << 8) | uint16(memoryValue1)
-	if result != value {
-		t.Errorf("Expected memory value: %d, Got: %d", value, result)
-	}
+	assertMemoryRangeEquals(t, ctx, db, ROM_SIZE+addr, []byte{byte(value), byte(value >> 8)})
 }
 
 func TestInstruction_sw(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1068,24 +1104,122 @@ func TestInstruction_sw(t *testing.T) {
 	failErr(t, err)
 
 	assertPCIncremented(t, ctx, db, 0)
+	assertMemoryRangeEquals(t, ctx, db, ROM_SIZE+addr, []byte{byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24)})
+}
+
+/**
+ * Misaligned loads and stores are supported (no trap): memory is byte addressed, so a word at an odd address
+ * is just 4 consecutive little-endian bytes. These pin that down.
+ */
+
+func TestInstruction_sw_unaligned(t *testing.T) {
+	ctx := testContext(t)
+	db, err := getDB()
+	failErr(t, err)
+
+	err = resetCPU(ctx, db)
+	failErr(t, err)
 
-	memoryValue1, err := getMemory(ctx, db, ROM_SIZE+addr)
+	// sw t1, 25(t0)
+	err = loadProgram(ctx, db, true, "0062aca3")
 	failErr(t, err)
-	memoryValue2, err := getMemory(ctx, db, ROM_SIZE+addr+1)
+
+	var addr uint32 = 25
+	var value uint32 = 0xABCDEF12
+	err = setRegister(ctx, db, regAddr("t0"), ROM_SIZE)
 	failErr(t, err)
-	memoryValue3, err := getMemory(ctx, db, ROM_SIZE+addr+2)
+	err = setRegister(ctx, db, regAddr("t1"), value)
 	failErr(t, err)
-	memoryValue4, err := getMemory(ctx, db, ROM_SIZE+addr+3)
+
+	err = clockCPU(ctx, db, "sw_unaligned")
 	failErr(t, err)
 
-	result := (uint32(memoryValue4) << 24) | (uint32(memoryValue3) << 16) | (uint32(memoryValue2) << 8) | uint32(memoryValue1)
-	if result != value {
-		t.Errorf("Expected memory value: %d, Got: %d", value, result)
-	}
+	assertPCIncremented(t, ctx, db, 0)
+
+	// Neighbours are untouched
+	assertMemoryRangeEquals(t, ctx, db, ROM_SIZE+addr-1, []byte{0x00, 0x12, 0xEF, 0xCD, 0xAB, 0x00})
+}
+
+func TestInstruction_lw_unaligned(t *testing.T) {
+	ctx := testContext(t)
+	db, err := getDB()
+	failErr(t, err)
+
+	err = resetCPU(ctx, db)
+	failErr(t, err)
+
+	// lw t2, 25(t0)
+	err = loadProgram(ctx, db, true, "0192a383")
+	failErr(t, err)
+
+	var addr uint32 = 25
+	var value uint32 = 0xABCDEF12
+	err = setRegister(ctx, db, regAddr("t0"), ROM_SIZE)
+	failErr(t, err)
+	err = setMemoryRange(ctx, db, ROM_SIZE+addr, []byte{byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24)})
+	failErr(t, err)
+
+	err = clockCPU(ctx, db, "lw_unaligned")
+	failErr(t, err)
+
+	assertPCIncremented(t, ctx, db, 0)
+	assertRegisterEquals(t, ctx, db, regAddr("t2"), value)
+}
+
+func TestInstruction_sh_unaligned(t *testing.T) {
+	ctx := testContext(t)
+	db, err := getDB()
+	failErr(t, err)
+
+	err = resetCPU(ctx, db)
+	failErr(t, err)
+
+	// sh t1, 27(t0)
+	err = loadProgram(ctx, db, true, "00629da3")
+	failErr(t, err)
+
+	var addr uint32 = 27
+	var value uint16 = 0xBEEF
+	err = setRegister(ctx, db, regAddr("t0"), ROM_SIZE)
+	failErr(t, err)
+	err = setRegister(ctx, db, regAddr("t1"), uint32(value))
+	failErr(t, err)
+
+	err = clockCPU(ctx, db, "sh_unaligned")
+	failErr(t, err)
+
+	assertPCIncremented(t, ctx, db, 0)
+	assertMemoryRangeEquals(t, ctx, db, ROM_SIZE+addr, []byte{0xEF, 0xBE})
+}
+
+func TestInstruction_lhu_unaligned(t *testing.T) {
+	ctx := testContext(t)
+	db, err := getDB()
+	failErr(t, err)
+
+	err = resetCPU(ctx, db)
+	failErr(t, err)
+
+	// lhu t2, 27(t0)
+	err = loadProgram(ctx, db, true, "01b2d383")
+	failErr(t, err)
+
+	var addr uint32 = 27
+	var value uint16 = 0xBEEF
+	err = setRegister(ctx, db, regAddr("t0"), ROM_SIZE)
+	failErr(t, err)
+	err = setMemoryRange(ctx, db, ROM_SIZE+addr, []byte{byte(value), byte(value >> 8)})
+	failErr(t, err)
+
+	err = clockCPU(ctx, db, "lhu_unaligned")
+	failErr(t, err)
+
+	assertPCIncremented(t, ctx, db, 0)
+	assertRegisterEquals(t, ctx, db, regAddr("t2"), uint32(value))
 }
 
 func TestInstruction_jal(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1108,7 +1242,7 @@ func TestInstruction_jal(t *testing.T) {
 }
 
 func TestInstruction_jalr(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1138,7 +1272,7 @@ func TestInstruction_jalr(t *testing.T) {
 }
 
 func TestInstruction_beq_true(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1164,7 +1298,7 @@ func TestInstruction_beq_true(t *testing.T) {
 }
 
 func TestInstruction_beq_false(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1189,7 +1323,7 @@ func TestInstruction_beq_false(t *testing.T) {
 }
 
 func TestInstruction_bne_true(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1215,7 +1349,7 @@ func TestInstruction_bne_true(t *testing.T) {
 }
 
 func TestInstruction_bne_false(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1240,7 +1374,7 @@ func TestInstruction_bne_false(t *testing.T) {
 }
 
 func TestInstruction_blt_true(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1268,7 +1402,7 @@ func TestInstruction_blt_true(t *testing.T) {
 }
 
 func TestInstruction_blt_false(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1295,7 +1429,7 @@ func TestInstruction_blt_false(t *testing.T) {
 }
 
 func TestInstruction_bge_true(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1323,7 +1457,7 @@ func TestInstruction_bge_true(t *testing.T) {
 }
 
 func TestInstruction_bge_false(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1350,7 +1484,7 @@ func TestInstruction_bge_false(t *testing.T) {
 }
 
 func TestInstruction_bltu_true(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1376,7 +1510,7 @@ func TestInstruction_bltu_true(t *testing.T) {
 }
 
 func TestInstruction_bltu_false(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1401,7 +1535,7 @@ func TestInstruction_bltu_false(t *testing.T) {
 }
 
 func TestInstruction_bgeu_true(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1427,7 +1561,7 @@ func TestInstruction_bgeu_true(t *testing.T) {
 }
 
 func TestInstruction_bgeu_false(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1452,7 +1586,7 @@ func TestInstruction_bgeu_false(t *testing.T) {
 }
 
 func TestInstruction_ecall_print(t *testing.T) {
-	ctx := context.Background()
+	ctx := testContext(t)
 	db, err := getDB()
 	failErr(t, err)
 
@@ -1485,15 +1619,105 @@ func TestInstruction_ecall_print(t *testing.T) {
 
 	assertPCIncremented(t, ctx, db, 0)
 
-	// Check if the message was printed
+	assertPrinted(t, ctx, db, msg)
+}
+
+func TestInstruction_ecall_print_clamped_to_memory(t *testing.T) {
+	ctx := testContext(t)
+	db, err := getDB()
+	failErr(t, err)
+
+	err = resetCPU(ctx, db)
+	failErr(t, err)
+
+	err = db.Exec(ctx, "TRUNCATE TABLE clickv.print")
+	failErr(t, err)
+
+	// ecall
+	err = loadProgram(ctx, db, true, "00000073")
+	failErr(t, err)
+
+	// Only "Click" fits before the end of RAM, the rest of the length points past it
+	msg := "Click"
+	msgAddr := MEM_SIZE - uint32(len(msg))
+	err = setMemoryRange(ctx, db, msgAddr, []byte(msg))
+	failErr(t, err)
+
+	err = setRegister(ctx, db, regAddr("a0"), msgAddr) // address of msg
+	failErr(t, err)
+	err = setRegister(ctx, db, regAddr("a1"), uint32(len("ClickHouse!"))) // length past the end of memory
+	failErr(t, err)
+	err = setRegister(ctx, db, regAddr("a7"), uint32(0x1)) // print syscall
+	failErr(t, err)
+
+	err = clockCPU(ctx, db, "ecall_print_clamped")
+	failErr(t, err)
+
+	assertPCIncremented(t, ctx, db, 0)
+	assertPrinted(t, ctx, db, msg)
+}
+
+// assertPrinted checks that exactly one message was printed since clickv.print was cleared
+func assertPrinted(t *testing.T, ctx context.Context, db driver.Conn, expected string) {
+	var rows uint64
+	err := db.QueryRow(ctx, "SELECT count() FROM clickv.print").Scan(&rows)
+	failErr(t, err)
+	if rows != 1 {
+		t.Fatalf("Expected 1 printed message, got %d", rows)
+	}
+
 	var outputMsg string
 	err = db.QueryRow(ctx, "SELECT message FROM clickv.print LIMIT 1").Scan(&outputMsg)
 	failErr(t, err)
+	if outputMsg != expected {
+		t.Errorf("Expected printed message: %q, Got: %q", expected, outputMsg)
+	}
+}
+
+func TestProgram_countdown_loop(t *testing.T) {
+	ctx := testContext(t)
+	db, err := getDB()
+	failErr(t, err)
+
+	err = resetCPU(ctx, db)
+	failErr(t, err)
 
+	const iterations = 5
+	err = loadProgram(ctx, db, false, programHex(
+		"00500293", // 0x0: addi t0, zero, 5
+		"00130313", // 0x4: addi t1, t1, 1
+		"fff28293", // 0x8: addi t0, t0, -1
+		"fe029ce3", // 0xC: bne t0, zero, -8
+	))
+	failErr(t, err)
+
+	const endPC uint32 = 0x10
+	const expectedCycles = 1 + iterations*3
+	cycles := 0
+	for ; cycles < expectedCycles*2; cycles++ {
+		pc, err := getPC(ctx, db)
+		failErr(t, err)
+		if pc == endPC {
+			break
+		} else if pc > endPC {
+			t.Fatalf("PC left the program at cycle %d: 0x%X", cycles, pc)
+		}
+
+		err = clockCPU(ctx, db, "countdown_loop")
+		failErr(t, err)
+	}
+
+	if cycles != expectedCycles {
+		t.Errorf("Expected loop to finish in %d cycles, took %d", expectedCycles, cycles)
+	}
+	assertPCEquals(t, ctx, db, endPC)
+	assertRegisterEquals(t, ctx, db, regAddr("t0"), 0)
+	assertRegisterEquals(t, ctx, db, regAddr("t1"), iterations)
 }
 
 func TestMain(m *testing.M) {
 	status := m.Run()
+	closeDB()
 	PrintInstructionPerf()
 	os.Exit(status)
 }
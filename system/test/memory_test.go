@@ -0,0 +1,39 @@
+package test
+
+import (
+	"bytes"
+	"testing"
+
+	"clickhouse.com/clickv/internal/db"
+)
+
+func TestDiffMemory(t *testing.T) {
+	before := make([]byte, 4096)
+	after := make([]byte, 4100)
+	after[10], after[11] = 0xAA, 0xBB
+	before[2000], after[2000] = 1, 2
+	after[4098] = 7 // past the end of before
+
+	diffs := db.DiffMemory(before, after)
+	expected := []db.MemoryDiff{
+		{Start: 10, Old: []byte{0, 0}, New: []byte{0xAA, 0xBB}},
+		{Start: 2000, Old: []byte{1}, New: []byte{2}},
+		{Start: 4096, Old: []byte{}, New: []byte{0, 0, 7, 0}},
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("expected %d ranges, got %+v", len(expected), diffs)
+	}
+	for i, want := range expected {
+		got := diffs[i]
+		if got.Start != want.Start || !bytes.Equal(got.Old, want.Old) || !bytes.Equal(got.New, want.New) {
+			t.Fatalf("range %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+	if diffs[2].Len() != 4 {
+		t.Fatalf("expected the tail range to be 4 bytes, got %d", diffs[2].Len())
+	}
+
+	if diffs := db.DiffMemory(before, before); len(diffs) != 0 {
+		t.Fatalf("expected identical images to produce no ranges, got %d", len(diffs))
+	}
+}